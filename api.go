@@ -0,0 +1,334 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/egandro/news-deframer/gen/api"
+	"github.com/egandro/news-deframer/pkg/database"
+	"github.com/egandro/news-deframer/pkg/deframer"
+	"goa.design/clue/log"
+)
+
+// api service implementation
+type apisrvc struct {
+	d deframer.Deframer
+}
+
+// NewAPI returns the api service implementation.
+func NewAPI(d deframer.Deframer) api.Service {
+	return &apisrvc{d: d}
+}
+
+// Lists the deframed feeds
+func (s *apisrvc) Feeds(ctx context.Context) (res []*api.Feed, err error) {
+	log.Printf(ctx, "api.feeds")
+
+	feeds, err := s.d.FindAllFeeds()
+	if err != nil {
+		return nil, err
+	}
+
+	res = []*api.Feed{}
+	for _, feed := range feeds {
+		current := &api.Feed{
+			ID:        feed.ID,
+			URL:       feed.Url,
+			Title:     feed.Title,
+			UpdatedAt: feed.UpdatedAt.UTC().Format(time.RFC3339),
+		}
+		if feed.FetchedAt != nil {
+			fetchedAt := feed.FetchedAt.UTC().Format(time.RFC3339)
+			current.FetchedAt = &fetchedAt
+		}
+		if feed.Status != "" {
+			current.Status = &feed.Status
+		}
+		if feed.Error != "" {
+			current.Error = &feed.Error
+		}
+		res = append(res, current)
+	}
+
+	return res, nil
+}
+
+// Lists the analyzed items, newest first
+func (s *apisrvc) Items(ctx context.Context, p *api.ItemsPayload) (res *api.ItemList, err error) {
+	log.Printf(ctx, "api.items")
+
+	filter, err := newItemFilter(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// fetch one more item to know if there is a next page
+	filter.Limit = p.Limit + 1
+	items, err := s.d.FindItems(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	res = &api.ItemList{Items: []*api.Item{}}
+
+	if len(items) > p.Limit {
+		items = items[:p.Limit]
+		cursor := encodeCursor(items[len(items)-1].ID)
+		res.NextCursor = &cursor
+	}
+
+	for _, item := range items {
+		res.Items = append(res.Items, newAPIItem(&item))
+	}
+
+	return res, nil
+}
+
+// Returns the analyzed item of a page url, the url is canonicalized
+func (s *apisrvc) Lookup(ctx context.Context, p *api.LookupPayload) (res *api.Item, err error) {
+	log.Printf(ctx, "api.lookup")
+
+	items, err := s.d.LookupURLs([]string{p.URL})
+	if err != nil {
+		return nil, err
+	}
+
+	if items[0] == nil {
+		return nil, api.UnknownURL(fmt.Sprintf("url %v not found", p.URL))
+	}
+
+	return newAPIItem(items[0]), nil
+}
+
+// Returns the analyzed items of page urls, e.g. all links of a page
+func (s *apisrvc) LookupBatch(ctx context.Context, p *api.LookupBatchPayload) (res []*api.PageLookup, err error) {
+	log.Printf(ctx, "api.lookup_batch")
+
+	items, err := s.d.LookupURLs(p.Urls)
+	if err != nil {
+		return nil, err
+	}
+
+	res = []*api.PageLookup{}
+	for i, u := range p.Urls {
+		current := &api.PageLookup{URL: u}
+		if items[i] != nil {
+			current.Item = newAPIItem(items[i])
+		}
+		res = append(res, current)
+	}
+
+	return res, nil
+}
+
+// Lists the domains with analyzed items, refreshed after each feed update
+func (s *apisrvc) Domains(ctx context.Context) (res []*api.Domain, err error) {
+	log.Printf(ctx, "api.domains")
+
+	domains, err := s.d.FindAllDomains()
+	if err != nil {
+		return nil, err
+	}
+
+	res = []*api.Domain{}
+	for _, domain := range domains {
+		current := &api.Domain{
+			Name:          domain.Name,
+			Items:         domain.Items,
+			AverageScores: []*api.Score{},
+			UpdatedAt:     domain.UpdatedAt.UTC().Format(time.RFC3339),
+		}
+		for _, score := range domain.Scores() {
+			if score.Score == nil {
+				continue
+			}
+			current.AverageScores = append(current.AverageScores, &api.Score{
+				Type:  score.Type,
+				Score: *score.Score,
+			})
+		}
+		res = append(res, current)
+	}
+
+	return res, nil
+}
+
+// Lists the AI token usage per day, feed and model, newest day first
+func (s *apisrvc) Usage(ctx context.Context, p *api.UsagePayload) (res []*api.DailyUsage, err error) {
+	log.Printf(ctx, "api.usage")
+
+	since := time.Now().AddDate(0, 0, 1-p.Days)
+	usage, err := s.d.FindUsage(since)
+	if err != nil {
+		return nil, err
+	}
+
+	res = []*api.DailyUsage{}
+	for _, u := range usage {
+		res = append(res, &api.DailyUsage{
+			Day:              u.Day,
+			FeedURL:          u.FeedUrl,
+			Model:            u.Model,
+			Calls:            u.Calls,
+			FailedCalls:      u.FailedCalls,
+			PromptTokens:     u.PromptTokens,
+			CompletionTokens: u.CompletionTokens,
+			AverageLatencyMs: u.AverageLatencyMs,
+			Cost:             u.Cost,
+		})
+	}
+
+	return res, nil
+}
+
+// Returns the domains with analyzed items as uBlock Origin / AdGuard filter list of marker rules
+func (s *apisrvc) FilterList(ctx context.Context) (res *api.FilterListResult, resp io.ReadCloser, err error) {
+	res = &api.FilterListResult{}
+	log.Printf(ctx, "api.filter_list")
+
+	domains, err := s.d.FindAllDomains()
+	if err != nil {
+		return res, resp, err
+	}
+
+	list := renderFilterList(domains)
+
+	res.Type = "text/plain;charset=UTF-8"
+	res.Length = int64(len(list))
+
+	// resp is the HTTP response body stream.
+	resp = io.NopCloser(strings.NewReader(list))
+
+	return
+}
+
+// supportedMarker is the selector of the filter list rules, an element no page has
+const supportedMarker = "deframer-supported"
+
+// renderFilterList returns a filter list with a "domain##deframer-supported" rule per domain.
+// The cosmetic rules mark the supported sites for the extension configuration, they don't block
+// or hide anything if the list is subscribed in an ad blocker.
+func renderFilterList(domains []database.Domain) string {
+	updated := time.Time{}
+	for _, domain := range domains {
+		if domain.UpdatedAt.After(updated) {
+			updated = domain.UpdatedAt
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("! Title: Deframer supported sites\n")
+	sb.WriteString("! Description: Domains with items analyzed by the Deframer proxy\n")
+	if !updated.IsZero() {
+		sb.WriteString("! Last modified: " + updated.UTC().Format(time.RFC3339) + "\n")
+	}
+	for _, domain := range domains {
+		sb.WriteString(domain.Name + "##" + supportedMarker + "\n")
+	}
+
+	return sb.String()
+}
+
+func newItemFilter(p *api.ItemsPayload) (database.ItemFilter, error) {
+	filter := database.ItemFilter{
+		MinScore: p.MinScore,
+		MaxScore: p.MaxScore,
+	}
+
+	if p.FeedURL != nil {
+		filter.FeedUrl = *p.FeedURL
+	}
+
+	if p.Lang != nil {
+		filter.Language = *p.Lang
+	}
+
+	if p.ScoreType != nil {
+		filter.ScoreType = *p.ScoreType
+	}
+
+	// the format is validated by the design
+	if p.Since != nil {
+		since, err := time.Parse(time.RFC3339, *p.Since)
+		if err != nil {
+			return filter, err
+		}
+		filter.Since = &since
+	}
+
+	if p.Until != nil {
+		until, err := time.Parse(time.RFC3339, *p.Until)
+		if err != nil {
+			return filter, err
+		}
+		filter.Until = &until
+	}
+
+	if p.Cursor != nil {
+		id, err := decodeCursor(*p.Cursor)
+		if err != nil {
+			return filter, api.InvalidCursor("invalid cursor " + *p.Cursor)
+		}
+		filter.BeforeID = id
+	}
+
+	return filter, nil
+}
+
+func newAPIItem(item *database.Item) *api.Item {
+	res := &api.Item{
+		ID:            item.ID,
+		FeedURL:       item.FeedUrl,
+		Link:          item.Link,
+		GUID:          item.Guid,
+		Title:         item.Title,
+		Description:   item.Description,
+		TitleAi:       item.TitleAI,
+		DescriptionAi: item.DescriptionAI,
+		MaxScore:      item.MaxScore(),
+		Scores:        []*api.Score{},
+		CreatedAt:     item.CreatedAt.UTC().Format(time.RFC3339),
+		UpdatedAt:     item.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+
+	if item.Language != "" {
+		res.Language = &item.Language
+	}
+
+	for _, score := range item.Scores() {
+		if score.Score == nil {
+			continue
+		}
+		res.Scores = append(res.Scores, &api.Score{
+			Type:   score.Type,
+			Score:  *score.Score,
+			Reason: score.Reason,
+		})
+	}
+
+	return res
+}
+
+// encodeCursor returns an opaque cursor for the items after the item with the given id
+func encodeCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(id), 10)))
+}
+
+func decodeCursor(cursor string) (uint, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint(id), nil
+}
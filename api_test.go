@@ -0,0 +1,38 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/egandro/news-deframer/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderFilterList(t *testing.T) {
+	updated := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	domains := []database.Domain{
+		{Name: "example.com", Items: 2, UpdatedAt: updated.Add(-time.Hour)},
+		{Name: "news.example.org", Items: 1, UpdatedAt: updated},
+	}
+
+	list := renderFilterList(domains)
+	lines := strings.Split(strings.TrimSuffix(list, "\n"), "\n")
+
+	assert.Equal(t, []string{
+		"! Title: Deframer supported sites",
+		"! Description: Domains with items analyzed by the Deframer proxy",
+		"! Last modified: 2024-05-01T12:00:00Z",
+		"example.com##deframer-supported",
+		"news.example.org##deframer-supported",
+	}, lines)
+
+	for _, line := range lines {
+		// network rules would block the sites
+		assert.NotContains(t, line, "||")
+		assert.NotContains(t, line, "^")
+	}
+
+	// no last modified without domains
+	assert.Equal(t, "! Title: Deframer supported sites\n! Description: Domains with items analyzed by the Deframer proxy\n", renderFilterList(nil))
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"time"
 
 	"github.com/egandro/news-deframer/pkg/config"
 	"github.com/egandro/news-deframer/pkg/deframer"
@@ -10,10 +9,8 @@ import (
 	"goa.design/clue/log"
 )
 
-const deleteOrphanedJobsTime = 10 * time.Minute
-
-// bootstrap our own services
-func bootstrap(ctx context.Context, httpPortF *string, dbgF *bool) (outHttpPortF *string, outDbgF *bool) {
+// bootstrap our own services, the deframer is shared by all services
+func bootstrap(ctx context.Context, httpPortF *string, dbgF *bool) (d deframer.Deframer, outHttpPortF *string, outDbgF *bool) {
 	outHttpPortF = httpPortF
 	outDbgF = dbgF
 
@@ -32,15 +29,33 @@ func bootstrap(ctx context.Context, httpPortF *string, dbgF *bool) (outHttpPortF
 		*outDbgF = true
 	}
 
-	d, err := deframer.NewDeframer(ctx)
+	d, err = deframer.NewDeframer(ctx)
 	if err != nil {
 		log.Fatalf(ctx, err, "can't create deframer")
 	}
 
-	_, err = d.UpdateFeeds()
+	report, err := d.UpdateFeeds()
 	if err != nil {
 		log.Fatalf(ctx, err, "can't update feeds")
 	}
 
+	for _, feed := range report.Feeds {
+		switch {
+		case feed.Err != nil:
+			log.Printf(ctx, "feed %q failed: %v", feed.FeedUrl, feed.Err)
+		case feed.Skipped:
+			log.Printf(ctx, "feed %q is up to date", feed.FeedUrl)
+		case feed.NotModified:
+			log.Printf(ctx, "feed %q is not modified", feed.FeedUrl)
+		default:
+			log.Printf(ctx, "feed %q updated, items=%d skipped=%d failed=%d", feed.FeedUrl, feed.Items, feed.SkippedItems, feed.FailedItems)
+		}
+	}
+	log.Printf(ctx, "updated %v feeds, %v failed", report.Updated(), len(report.Failed()))
+
+	if cfg.PruneInterval > 0 {
+		prune(ctx, d)
+	}
+
 	return
 }
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"net/http"
 	"net/url"
 	"regexp"
 	"sync"
 	"time"
 
+	api "github.com/egandro/news-deframer/gen/api"
+	apisvr "github.com/egandro/news-deframer/gen/http/api/server"
 	privatesvr "github.com/egandro/news-deframer/gen/http/private/server"
 	websvr "github.com/egandro/news-deframer/gen/http/web/server"
 	private "github.com/egandro/news-deframer/gen/private"
@@ -19,7 +22,7 @@ import (
 
 // handleHTTPServer starts configures and starts a HTTP server on the given
 // URL. It shuts down the server if any error is received in the error channel.
-func handleHTTPServer(ctx context.Context, u *url.URL, privateEndpoints *private.Endpoints, webEndpoints *web.Endpoints, wg *sync.WaitGroup, errc chan error, dbg bool) {
+func handleHTTPServer(ctx context.Context, u *url.URL, apiEndpoints *api.Endpoints, privateEndpoints *private.Endpoints, webEndpoints *web.Endpoints, wg *sync.WaitGroup, errc chan error, dbg bool) {
 
 	// Provide the transport specific request decoder and response encoder.
 	// The goa http package has built-in support for JSON, XML and gob.
@@ -48,16 +51,20 @@ func handleHTTPServer(ctx context.Context, u *url.URL, privateEndpoints *private
 	// the service input and output data structures to HTTP requests and
 	// responses.
 	var (
+		apiServer     *apisvr.Server
 		privateServer *privatesvr.Server
 		webServer     *websvr.Server
 	)
 	{
 		eh := errorHandler(ctx)
+		apiServer = apisvr.New(apiEndpoints, mux, dec, enc, eh, nil)
 		privateServer = privatesvr.New(privateEndpoints, mux, dec, enc, eh, nil)
 		webServer = websvr.New(webEndpoints, mux, dec, enc, eh, nil)
 	}
 
 	// Configure the mux.
+	mux.Handle("GET", "/metrics", expvar.Handler().ServeHTTP)
+	apisvr.Mount(mux, apiServer)
 	privatesvr.Mount(mux, privateServer)
 	websvr.Mount(mux, webServer)
 
@@ -74,6 +81,9 @@ func handleHTTPServer(ctx context.Context, u *url.URL, privateEndpoints *private
 	// Start HTTP server using default configuration, change the code to
 	// configure the server as required by your service.
 	srv := &http.Server{Addr: u.Host, Handler: handler, ReadHeaderTimeout: time.Second * 60}
+	for _, m := range apiServer.Mounts {
+		log.Printf(ctx, "HTTP %q mounted on %s %s", m.Method, m.Verb, m.Pattern)
+	}
 	for _, m := range privateServer.Mounts {
 		log.Printf(ctx, "HTTP %q mounted on %s %s", m.Method, m.Verb, m.Pattern)
 	}
@@ -12,6 +12,7 @@ import (
 	"syscall"
 
 	service "github.com/egandro/news-deframer"
+	api "github.com/egandro/news-deframer/gen/api"
 	private "github.com/egandro/news-deframer/gen/private"
 	web "github.com/egandro/news-deframer/gen/web"
 	"goa.design/clue/debug"
@@ -37,7 +38,16 @@ func main() {
 		format = log.FormatTerminal
 	}
 	ctx := log.Context(context.Background(), log.WithFormat(format))
-	httpPortF, dbgF = bootstrap(ctx, httpPortF, dbgF)
+
+	if flag.Arg(0) == "migrate" {
+		migrate(ctx, flag.Args()[1:])
+		return
+	}
+
+	// The deframer lives as long as the servers, cancelling stops running updates.
+	ctx, cancel := context.WithCancel(ctx)
+
+	d, httpPortF, dbgF := bootstrap(ctx, httpPortF, dbgF)
 	if *dbgF {
 		ctx = log.Context(ctx, log.WithDebug())
 		log.Debugf(ctx, "debug logs enabled")
@@ -46,21 +56,27 @@ func main() {
 
 	// Initialize the services.
 	var (
+		apiSvc     api.Service
 		privateSvc private.Service
 		webSvc     web.Service
 	)
 	{
+		apiSvc = service.NewAPI(d)
 		privateSvc = service.NewPrivate()
-		webSvc = service.NewWeb()
+		webSvc = service.NewWeb(d)
 	}
 
 	// Wrap the services in endpoints that can be invoked from other services
 	// potentially running in different processes.
 	var (
+		apiEndpoints     *api.Endpoints
 		privateEndpoints *private.Endpoints
 		webEndpoints     *web.Endpoints
 	)
 	{
+		apiEndpoints = api.NewEndpoints(apiSvc)
+		apiEndpoints.Use(debug.LogPayloads())
+		apiEndpoints.Use(log.Endpoint)
 		privateEndpoints = private.NewEndpoints(privateSvc)
 		privateEndpoints.Use(debug.LogPayloads())
 		privateEndpoints.Use(log.Endpoint)
@@ -82,7 +98,6 @@ func main() {
 	}()
 
 	var wg sync.WaitGroup
-	ctx, cancel := context.WithCancel(ctx)
 
 	// Start the servers and send errors (if any) to the error channel.
 	switch *hostF {
@@ -108,7 +123,7 @@ func main() {
 			} else if u.Port() == "" {
 				u.Host = net.JoinHostPort(u.Host, "80")
 			}
-			handleHTTPServer(ctx, u, privateEndpoints, webEndpoints, &wg, errc, *dbgF)
+			handleHTTPServer(ctx, u, apiEndpoints, privateEndpoints, webEndpoints, &wg, errc, *dbgF)
 		}
 
 		{
@@ -139,6 +154,10 @@ func main() {
 		log.Fatal(ctx, fmt.Errorf("invalid host argument: %q (valid hosts: default)", *hostF))
 	}
 
+	// Refresh the feeds in the background, reload them on change.
+	s := handleScheduler(ctx, &wg, d)
+	handleReload(ctx, &wg, d, s)
+
 	// Wait for signal.
 	log.Printf(ctx, "exiting (%v)", <-errc)
 
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/egandro/news-deframer/pkg/config"
+	"github.com/egandro/news-deframer/pkg/database"
+	"github.com/joho/godotenv"
+	"goa.design/clue/log"
+)
+
+// migrate runs the migrate subcommand: "migrate [up|down <version>|status]"
+func migrate(ctx context.Context, args []string) {
+	_ = godotenv.Load() // load .env file - if exist
+	cfg, err := config.GetDatabaseConfig()
+	if err != nil {
+		log.Fatalf(ctx, err, "can't initialize config")
+	}
+
+	db, err := database.OpenDatabase(cfg.DSN())
+	if err != nil {
+		log.Fatalf(ctx, err, "can't open database")
+	}
+
+	current, err := db.SchemaVersion()
+	if err != nil {
+		log.Fatalf(ctx, err, "can't read schema version")
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	target := database.LatestSchemaVersion()
+	switch command {
+	case "status":
+		log.Printf(ctx, "schema version %v, latest %v", current, target)
+		return
+	case "up":
+	case "down":
+		if len(args) < 2 {
+			log.Fatalf(ctx, fmt.Errorf("missing version"), "usage: migrate down <version>")
+		}
+		target, err = strconv.Atoi(args[1])
+		if err != nil {
+			log.Fatalf(ctx, err, "invalid version %q", args[1])
+		}
+		if target > current {
+			log.Fatalf(ctx, fmt.Errorf("version %v is newer than %v", target, current), "use migrate up")
+		}
+	default:
+		log.Fatalf(ctx, fmt.Errorf("unknown command %q", command), "usage: migrate [up|down <version>|status]")
+	}
+
+	if current > database.LatestSchemaVersion() {
+		log.Fatalf(ctx, database.ErrSchemaTooNew, "schema version %v, latest %v", current, database.LatestSchemaVersion())
+	}
+
+	err = db.Migrate(target)
+	if err != nil {
+		log.Fatalf(ctx, err, "can't migrate from version %v to %v", current, target)
+	}
+
+	log.Printf(ctx, "migrated from version %v to %v", current, target)
+}
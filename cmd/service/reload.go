@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/egandro/news-deframer/pkg/config"
+	"github.com/egandro/news-deframer/pkg/deframer"
+	"github.com/egandro/news-deframer/pkg/scheduler"
+	"github.com/egandro/news-deframer/pkg/source"
+	"goa.design/clue/log"
+)
+
+// handleReload reloads the source file on SIGHUP and when the file changed.
+// It stops when the context is cancelled.
+func handleReload(ctx context.Context, wg *sync.WaitGroup, d deframer.Deframer, s scheduler.Scheduler) {
+	cfg, err := config.GetConfig()
+	if err != nil {
+		log.Fatalf(ctx, err, "can't initialize config")
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// a nil channel never receives
+	var changed <-chan struct{}
+	if cfg.SourceWatchInterval > 0 {
+		changed = source.Watch(ctx, cfg.Source, cfg.SourceWatchInterval)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				log.Printf(ctx, "reloading %q on SIGHUP", cfg.Source)
+			case _, ok := <-changed:
+				if !ok {
+					return
+				}
+				log.Printf(ctx, "reloading %q, the file changed", cfg.Source)
+			}
+
+			reload(ctx, d, s)
+		}
+	}()
+}
+
+// reload replaces the feeds and prompts, an invalid source file keeps the current ones
+func reload(ctx context.Context, d deframer.Deframer, s scheduler.Scheduler) {
+	err := d.Reload()
+	if err != nil {
+		log.Errorf(ctx, err, "can't reload, keeping the current feeds and prompts")
+		return
+	}
+
+	// new feeds are refreshed right away by the scheduler
+	s.Update(d.Feeds())
+
+	log.Printf(ctx, "reloaded %v feeds", len(d.Feeds()))
+}
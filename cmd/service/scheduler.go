@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/egandro/news-deframer/pkg/config"
+	"github.com/egandro/news-deframer/pkg/deframer"
+	"github.com/egandro/news-deframer/pkg/scheduler"
+	"goa.design/clue/log"
+)
+
+// handleScheduler starts the periodic refresh and pruning of the feeds. Both
+// stop when the context is cancelled.
+func handleScheduler(ctx context.Context, wg *sync.WaitGroup, d deframer.Deframer) scheduler.Scheduler {
+	cfg, err := config.GetConfig()
+	if err != nil {
+		log.Fatalf(ctx, err, "can't initialize config")
+	}
+
+	s := scheduler.NewScheduler(d, d.Feeds(), cfg.RefreshInterval)
+	s.Start(ctx, wg)
+
+	if cfg.PruneInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runPruning(ctx, d, cfg.PruneInterval)
+		}()
+	}
+
+	return s
+}
+
+// runPruning prunes the database every interval until the context is cancelled
+func runPruning(ctx context.Context, d deframer.Deframer, interval time.Duration) {
+	log.Printf(ctx, "pruning every %v", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		prune(ctx, d)
+	}
+}
+
+func prune(ctx context.Context, d deframer.Deframer) {
+	res, err := d.Prune()
+	if err != nil {
+		// only log - try again on the next run
+		log.Errorf(ctx, err, "can't prune")
+		return
+	}
+
+	log.Printf(ctx, "pruned %v feeds, %v items, %v revisions and %v ratings", res.Feeds, res.Items, res.Revisions, res.Ratings)
+}
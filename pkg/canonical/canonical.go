@@ -0,0 +1,114 @@
+// Package canonical normalizes urls, so a page url matches the link of a feed item
+package canonical
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// trackingParams are removed from the query, keys ending with "_" are prefixes
+var trackingParams = []string{
+	"utm_",
+	"fbclid",
+	"gclid",
+	"dclid",
+	"msclkid",
+	"mc_cid",
+	"mc_eid",
+	"igshid",
+	"yclid",
+	"_ga",
+	"ref_src",
+	"ocid",
+	"cmpid",
+	"wt_mc",
+	"wt_zmc",
+}
+
+// URL returns the canonical form of a http(s) url: https, lowercase host without "www." and
+// default port, no trailing slash, no fragment, no tracking parameters and sorted query parameters.
+// Other urls are returned unchanged.
+func URL(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return raw
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return raw
+	}
+
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimPrefix(host, "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+
+	query := u.Query()
+	for key := range query {
+		if isTrackingParam(key) {
+			query.Del(key)
+		}
+	}
+
+	res := &url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     strings.TrimRight(u.Path, "/"),
+		RawQuery: query.Encode(), // sorted by key
+	}
+
+	return res.String()
+}
+
+// FeedURL returns the form of a http(s) feed url that identifies the feed: lowercase scheme and host,
+// no default port and no fragment. Unlike URL the scheme, "www.", the path and the query are kept,
+// they can address another feed. Other urls are returned unchanged.
+func FeedURL(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return raw
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return raw
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && !(scheme == "http" && port == "80") && !(scheme == "https" && port == "443") {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		// IPv6
+		host = "[" + host + "]"
+	}
+
+	res := *u
+	res.Scheme = scheme
+	res.Host = host
+	res.Fragment = ""
+	res.RawFragment = ""
+
+	return res.String()
+}
+
+// Domain returns the canonical host of a http(s) url without the port, empty for other urls
+func Domain(raw string) string {
+	u, err := url.Parse(URL(raw))
+	if err != nil || u.Scheme != "https" {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func isTrackingParam(key string) bool {
+	key = strings.ToLower(key)
+	for _, param := range trackingParams {
+		if key == param || (strings.HasSuffix(param, "_") && strings.HasPrefix(key, param)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package canonical
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestURL(t *testing.T) {
+	tests := map[string]string{
+		"https://example.com/foo":                                "https://example.com/foo",
+		"http://www.Example.com/foo/":                            "https://example.com/foo",
+		"https://example.com:443/foo#comments":                   "https://example.com/foo",
+		"https://example.com:8443/foo":                           "https://example.com:8443/foo",
+		"https://example.com/foo?utm_source=rss&utm_medium=feed": "https://example.com/foo",
+		"https://example.com/foo?b=2&fbclid=123&a=1":             "https://example.com/foo?a=1&b=2",
+		"https://example.com/":                                   "https://example.com",
+		" https://example.com/foo ":                              "https://example.com/foo",
+		"mailto:info@example.com":                                "mailto:info@example.com",
+		"not a url":                                              "not a url",
+	}
+
+	for raw, expected := range tests {
+		assert.Equal(t, expected, URL(raw), raw)
+	}
+}
+
+func TestFeedURL(t *testing.T) {
+	tests := map[string]string{
+		"https://example.com/rss":                "https://example.com/rss",
+		"HTTPS://Example.com:443/rss#top":        "https://example.com/rss",
+		"http://example.com:80/rss?b=2&a=1":      "http://example.com/rss?b=2&a=1",
+		"http://www.example.com:8080/rss/":       "http://www.example.com:8080/rss/",
+		"https://[2001:DB8::1]:443/rss":          "https://[2001:db8::1]/rss",
+		"https://example.com/rss?utm_source=rss": "https://example.com/rss?utm_source=rss",
+		"file://dummy":                           "file://dummy",
+	}
+
+	for raw, expected := range tests {
+		assert.Equal(t, expected, FeedURL(raw), raw)
+	}
+}
+
+func TestDomain(t *testing.T) {
+	assert.Equal(t, "example.com", Domain("http://www.Example.com:8080/foo"))
+	assert.Equal(t, "news.example.com", Domain("https://news.example.com/"))
+	assert.Equal(t, "", Domain("mailto:info@example.com"))
+	assert.Equal(t, "", Domain(""))
+}
@@ -2,16 +2,69 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 )
 
 type Configuration struct {
-	HttpPort     string `required:"false" envconfig:"HTTP_PORT"`
-	DebugLog     bool   `required:"false" envconfig:"DEBUG_LOG" default:"false"`
+	DatabaseConfiguration
+	HttpPort  string `required:"false" envconfig:"HTTP_PORT"`
+	DebugLog  bool   `required:"false" envconfig:"DEBUG_LOG" default:"false"`
+	Source    string `required:"true" envconfig:"SOURCE_FILE" default:"/data/source.json"`
+	AI_URL    string `required:"false" envconfig:"AI_URL"`                          // the OpenAI API if empty
+	AI_Model  string `required:"false" envconfig:"AI_MODEL"`                        // the "default" backend, if set
+	AI_Output string `required:"false" envconfig:"AI_OUTPUT" default:"json_schema"` // json_schema, tools or text
+
+	AI_APIKey      string        `required:"false" envconfig:"AI_API_KEY"`
+	AI_APIKeyFile  string        `required:"false" envconfig:"AI_API_KEY_FILE"`             // e.g. a docker secret
+	AI_Timeout     time.Duration `required:"false" envconfig:"AI_TIMEOUT" default:"2m"`     // per query, a backend that times out fails over
+	AI_DailyTokens int64         `required:"false" envconfig:"AI_DAILY_TOKENS" default:"0"` // items are passed through above, 0 is unlimited
+
+	RefreshInterval time.Duration `required:"false" envconfig:"REFRESH_INTERVAL" default:"90m"`
+	Workers         int           `required:"false" envconfig:"WORKERS" default:"4"`            // items deframed at once
+	AI_Concurrency  int           `required:"false" envconfig:"AI_CONCURRENCY" default:"2"`     // queries per AI backend at once
+	TolerateErrors  bool          `required:"false" envconfig:"TOLERATE_ERRORS" default:"true"` // pass failed items through, skip failed feeds
+
+	SourceWatchInterval time.Duration `required:"false" envconfig:"SOURCE_WATCH_INTERVAL" default:"10s"` // reload the changed source file, 0 disables watching
+
+	FeedMaxSize int64 `required:"false" envconfig:"FEED_MAX_SIZE" default:"10485760"` // bytes of a downloaded feed, 0 is unlimited
+
+	RetentionAge   time.Duration `required:"false" envconfig:"RETENTION_AGE" default:"0"`    // items analyzed before are pruned, 0 keeps them
+	RetentionItems int           `required:"false" envconfig:"RETENTION_ITEMS" default:"0"`  // items kept per feed, 0 keeps them
+	PruneGrace     time.Duration `required:"false" envconfig:"PRUNE_GRACE" default:"168h"`   // items and proxied feeds gone for longer are pruned
+	PruneInterval  time.Duration `required:"false" envconfig:"PRUNE_INTERVAL" default:"24h"` // 0 disables pruning
+	Vacuum         bool          `required:"false" envconfig:"VACUUM" default:"false"`       // vacuum SQLite after pruning
+}
+
+// DatabaseConfiguration is the part of the configuration needed for the migrations
+type DatabaseConfiguration struct {
 	DatabaseFile string `required:"true" envconfig:"DATABASE_FILE" default:"/data/sqlite.db"`
-	Source       string `required:"true" envconfig:"SOURCE_FILE" default:"/data/source.json"`
-	AI_URL       string `required:"true" envconfig:"AI_URL"`
-	AI_Model     string `required:"true" envconfig:"AI_MODEL"`
+	DatabaseURL  string `required:"false" envconfig:"DATABASE_URL"` // postgres:// url, replaces DATABASE_FILE
+}
+
+// DSN returns the database url or file
+func (c *DatabaseConfiguration) DSN() string {
+	if c.DatabaseURL != "" {
+		return c.DatabaseURL
+	}
+	return c.DatabaseFile
+}
+
+// APIKey returns the API key of the default backend, AI_API_KEY_FILE is read if AI_API_KEY is empty
+func (c *Configuration) APIKey() (string, error) {
+	if c.AI_APIKey != "" || c.AI_APIKeyFile == "" {
+		return c.AI_APIKey, nil
+	}
+
+	data, err := os.ReadFile(c.AI_APIKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("can't read AI_API_KEY_FILE: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
 }
 
 var config *Configuration = nil
@@ -30,3 +83,14 @@ func GetConfig() (*Configuration, error) {
 	config = &s
 	return config, nil
 }
+
+// GetDatabaseConfig returns the database configuration, the other settings are not required
+func GetDatabaseConfig() (*DatabaseConfiguration, error) {
+	var s DatabaseConfiguration
+	err := envconfig.Process("", &s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
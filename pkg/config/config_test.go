@@ -17,3 +17,11 @@ func TestConfigValidity(t *testing.T) {
 
 	t.Logf("DatabaseFile %v", cfg.DatabaseFile)
 }
+
+func TestDatabaseDSN(t *testing.T) {
+	cfg := DatabaseConfiguration{DatabaseFile: "/data/sqlite.db"}
+	assert.Equal(t, "/data/sqlite.db", cfg.DSN())
+
+	cfg.DatabaseURL = "postgres://localhost/deframer"
+	assert.Equal(t, "postgres://localhost/deframer", cfg.DSN())
+}
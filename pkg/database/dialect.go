@@ -0,0 +1,35 @@
+package database
+
+import (
+	"strings"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// isPostgres reports if the dsn is a PostgreSQL url, all other dsns are SQLite files
+func isPostgres(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// open connects to the database of the dsn
+func open(dsn string) (*gorm.DB, error) {
+	if isPostgres(dsn) {
+		return gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	}
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows only one writer, an in-memory database exists only per connection
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	return db, nil
+}
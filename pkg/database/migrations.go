@@ -0,0 +1,407 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/egandro/news-deframer/pkg/canonical"
+	"gorm.io/gorm"
+)
+
+// ErrSchemaTooNew is returned if the database was migrated by a newer version of the program
+var ErrSchemaTooNew = errors.New("database schema is newer than the program")
+
+// schemaVersion is an applied migration
+type schemaVersion struct {
+	Version   int    `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"type:text;not null"`
+	AppliedAt time.Time
+}
+
+func (schemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// migration changes the schema from version-1 to version and back.
+// Migrations are never changed once released, new changes are appended.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+	down    func(tx *gorm.DB) error
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "baseline",
+		up:      baselineUp,
+		down:    baselineDown,
+	},
+	{
+		version: 2,
+		name:    "item last seen",
+		up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&itemLastSeen{}, "LastSeenAt"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&itemLastSeen{}, "LastSeenAt")
+		},
+		down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex(&itemLastSeen{}, "LastSeenAt"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&itemLastSeen{}, "LastSeenAt")
+		},
+	},
+	{
+		version: 3,
+		name:    "ensemble ratings",
+		up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&ensembleRating{}, &ensembleReputation{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&ensembleRating{}, &ensembleReputation{})
+		},
+	},
+	{
+		version: 4,
+		name:    "ai calls",
+		up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&usageAICall{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&usageAICall{})
+		},
+	},
+	{
+		version: 5,
+		name:    "skipped feed items",
+		up: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&feedItemSkipped{}, "Skipped")
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&feedItemSkipped{}, "Skipped")
+		},
+	},
+}
+
+// LatestSchemaVersion returns the schema version of the program
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the version of the database, 0 for an empty or unversioned database
+func (d *Database) SchemaVersion() (int, error) {
+	if !d.db.Migrator().HasTable(&schemaVersion{}) {
+		return 0, nil
+	}
+
+	var version int
+	err := d.db.Model(&schemaVersion{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// Migrate applies the up or down migrations to reach the version, each migration in its own transaction
+func (d *Database) Migrate(version int) error {
+	if version < 0 || version > LatestSchemaVersion() {
+		return fmt.Errorf("unknown schema version %v, latest is %v", version, LatestSchemaVersion())
+	}
+
+	err := d.db.AutoMigrate(&schemaVersion{})
+	if err != nil {
+		return err
+	}
+
+	current, err := d.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current || m.version > version {
+			continue
+		}
+		err := d.db.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&schemaVersion{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %v (%v): %w", m.version, m.name, err)
+		}
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= version {
+			continue
+		}
+		err := d.db.Transaction(func(tx *gorm.DB) error {
+			if err := m.down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&schemaVersion{}, m.version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %v (%v) down: %w", m.version, m.name, err)
+		}
+	}
+
+	return nil
+}
+
+// The tables of the baseline. They are copies of the models at version 1,
+// later changes of the models need their own migration.
+
+type baselineItem struct {
+	gorm.Model
+	Hash             string `gorm:"type:text;uniqueIndex;not null"`
+	Fingerprint      string `gorm:"type:text;not null;default:''"`
+	FeedUrl          string `gorm:"type:text;not null"`
+	Link             string `gorm:"type:text;not null"`
+	CanonicalLink    string `gorm:"type:text;index;not null;default:''"`
+	Domain           string `gorm:"type:text;index;not null;default:''"`
+	Guid             string `gorm:"type:text;not null"`
+	Language         string `gorm:"type:text;not null;default:''"`
+	Title            string `gorm:"type:text;not null"`
+	Description      string `gorm:"type:text;not null"`
+	Content          string `gorm:"type:text;not null"`
+	Clickbait        *float64
+	Framing          *float64
+	PersuasiveIntent *float64
+	HyperStimulus    *float64
+	TitleAI          *string `gorm:"type:text"`
+	DescriptionAI    *string `gorm:"type:text"`
+	ReasonClickbait  *string `gorm:"type:text"`
+	ReasonFraming    *string `gorm:"type:text"`
+	ReasonPersuasive *string `gorm:"type:text"`
+	ReasonStimulus   *string `gorm:"type:text"`
+}
+
+func (baselineItem) TableName() string { return "items" }
+
+type baselineItemRevision struct {
+	gorm.Model
+	ItemID           uint   `gorm:"index;not null"`
+	Fingerprint      string `gorm:"type:text;not null"`
+	Title            string `gorm:"type:text;not null"`
+	Description      string `gorm:"type:text;not null"`
+	Content          string `gorm:"type:text;not null"`
+	Clickbait        *float64
+	Framing          *float64
+	PersuasiveIntent *float64
+	HyperStimulus    *float64
+	TitleAI          *string `gorm:"type:text"`
+	DescriptionAI    *string `gorm:"type:text"`
+	ReasonClickbait  *string `gorm:"type:text"`
+	ReasonFraming    *string `gorm:"type:text"`
+	ReasonPersuasive *string `gorm:"type:text"`
+	ReasonStimulus   *string `gorm:"type:text"`
+}
+
+func (baselineItemRevision) TableName() string { return "item_revisions" }
+
+type baselineFeed struct {
+	gorm.Model
+	Url          string `gorm:"type:text;uniqueIndex;not null"`
+	Title        string `gorm:"type:text;not null"`
+	Link         string `gorm:"type:text;not null;default:''"`
+	Description  string `gorm:"type:text;not null;default:''"`
+	Language     string `gorm:"type:text;not null;default:''"`
+	Metadata     string `gorm:"type:text;not null;default:''"`
+	ETag         string `gorm:"type:text;not null;default:''"`
+	LastModified string `gorm:"type:text;not null;default:''"`
+	FetchedAt    *time.Time
+	Status       string `gorm:"type:text;not null;default:''"`
+	Error        string `gorm:"type:text;not null;default:''"`
+}
+
+func (baselineFeed) TableName() string { return "feeds" }
+
+type baselineFeedItem struct {
+	ID       uint `gorm:"primaryKey"`
+	FeedID   uint `gorm:"uniqueIndex:idx_feed_position;not null"`
+	Position int  `gorm:"uniqueIndex:idx_feed_position;not null"`
+	ItemID   *uint
+	Item     *baselineItem `gorm:"constraint:OnDelete:SET NULL"`
+	Upstream string        `gorm:"type:text;not null"`
+}
+
+func (baselineFeedItem) TableName() string { return "feed_items" }
+
+type baselineDomain struct {
+	Name             string `gorm:"type:text;primaryKey"`
+	Items            int64  `gorm:"not null"`
+	Clickbait        *float64
+	Framing          *float64
+	PersuasiveIntent *float64
+	HyperStimulus    *float64
+	UpdatedAt        time.Time
+}
+
+func (baselineDomain) TableName() string { return "domains" }
+
+// itemLastSeen is the column of version 2
+type itemLastSeen struct {
+	LastSeenAt *time.Time `gorm:"index"`
+}
+
+func (itemLastSeen) TableName() string { return "items" }
+
+// ensembleRating is the rating table of version 3
+type ensembleRating struct {
+	ID               uint `gorm:"primarykey"`
+	CreatedAt        time.Time
+	ItemID           uint    `gorm:"index;not null"`
+	Fingerprint      string  `gorm:"type:text;not null;default:''"`
+	Backend          string  `gorm:"type:text;not null"`
+	Weight           float64 `gorm:"not null"`
+	Deviation        *float64
+	Clickbait        *float64
+	Framing          *float64
+	PersuasiveIntent *float64
+	HyperStimulus    *float64
+}
+
+func (ensembleRating) TableName() string { return "ratings" }
+
+// ensembleReputation is the reputation table of version 3
+type ensembleReputation struct {
+	Backend   string  `gorm:"type:text;primaryKey"`
+	Weight    float64 `gorm:"not null"`
+	Deviation float64 `gorm:"not null"`
+	Ratings   int64   `gorm:"not null"`
+	UpdatedAt time.Time
+}
+
+func (ensembleReputation) TableName() string { return "reputations" }
+
+// usageAICall is the AI call table of version 4
+type usageAICall struct {
+	ID               uint `gorm:"primarykey"`
+	CreatedAt        time.Time
+	Day              string `gorm:"type:text;index;not null"`
+	FeedUrl          string `gorm:"type:text;not null;default:''"`
+	Model            string `gorm:"type:text;not null"`
+	PromptTokens     int64  `gorm:"not null"`
+	CompletionTokens int64  `gorm:"not null"`
+	LatencyMs        int64  `gorm:"not null"`
+	Failed           bool   `gorm:"not null"`
+	Cost             *float64
+}
+
+func (usageAICall) TableName() string { return "ai_calls" }
+
+// feedItemSkipped is the column of version 5
+type feedItemSkipped struct {
+	Skipped bool `gorm:"not null;default:false"`
+}
+
+func (feedItemSkipped) TableName() string { return "feed_items" }
+
+// baselineUp creates the tables. Databases from before the versioned migrations are upgraded in place.
+func baselineUp(tx *gorm.DB) error {
+	// The framing reason was stored in reason_ai before there were multiple scores
+	if tx.Migrator().HasColumn("items", "reason_ai") {
+		err := tx.Migrator().RenameColumn("items", "reason_ai", "reason_framing")
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tx.AutoMigrate(&baselineItem{}, &baselineItemRevision{}, &baselineFeed{}, &baselineFeedItem{}, &baselineDomain{})
+	if err != nil {
+		return err
+	}
+
+	err = migrateEmbedded(tx)
+	if err != nil {
+		return err
+	}
+
+	// Items stored before canonical links and domains existed
+	var items []baselineItem
+	err = tx.Where("(canonical_link = '' OR domain = '') AND link <> ''").FindInBatches(&items, 500, func(_ *gorm.DB, _ int) error {
+		for _, item := range items {
+			err := tx.Model(&item).UpdateColumns(map[string]any{
+				"canonical_link": canonical.URL(item.Link),
+				"domain":         canonical.Domain(item.Link),
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	// The unique index of the hash was created twice, idx_items_hash of the model is kept
+	err = tx.Exec("DROP INDEX IF EXISTS idx_hash").Error
+	if err != nil {
+		return err
+	}
+
+	// The rendered feeds were stored in caches before there were feed rows.
+	// The ids are kept, they are part of the feed urls. The feeds are fetched again.
+	if tx.Migrator().HasTable("caches") {
+		err := tx.Exec(`INSERT INTO feeds (id, created_at, updated_at, url, title)
+			SELECT id, created_at, updated_at, feed_url, title FROM caches WHERE deleted_at IS NULL`).Error
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().DropTable("caches")
+	}
+
+	return nil
+}
+
+func baselineDown(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(&baselineFeedItem{}, &baselineFeed{}, &baselineItemRevision{}, &baselineItem{}, &baselineDomain{})
+}
+
+// migrateEmbedded restores the original title and content of items that were stored in the embedded form.
+// Items without the original title are analyzed again.
+func migrateEmbedded(tx *gorm.DB) error {
+	var items []baselineItem
+	return tx.Where("title LIKE 'Framing: %' AND title_ai IS NOT NULL").FindInBatches(&items, 500, func(_ *gorm.DB, _ int) error {
+		for _, item := range items {
+			// the embedded title: "Framing: <framing> - <title>"
+			if item.Framing == nil || item.Title != fmt.Sprintf("Framing: %v - %v", *item.Framing, *item.TitleAI) {
+				// an original title
+				continue
+			}
+
+			reason := ""
+			if item.ReasonFraming != nil {
+				reason = *item.ReasonFraming
+			}
+
+			// the embedded content: "Original title: <title> <br/> Reason: <reason> <br/> <content>"
+			updates := map[string]any{"fingerprint": "embedded"}
+			if rest, ok := strings.CutPrefix(item.Content, "Original title: "); ok {
+				if title, content, ok := strings.Cut(rest, fmt.Sprintf(" <br/> Reason: %v <br/> ", reason)); ok {
+					updates = map[string]any{
+						"title":   title,
+						"content": content,
+					}
+				}
+			}
+
+			err := tx.Model(&item).UpdateColumns(updates).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
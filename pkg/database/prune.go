@@ -0,0 +1,134 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RetentionPolicy selects the feeds and items that are pruned.
+// Items of the current feeds are never pruned, they would be analyzed again on the next update.
+type RetentionPolicy struct {
+	MaxAge          time.Duration // items analyzed before are pruned, 0 keeps them
+	MaxItemsPerFeed int           // older items above the count are pruned, 0 keeps them
+	Grace           time.Duration // items no longer in a feed and feeds not fetched since are pruned, 0 keeps them
+	KeepFeeds       []string      // urls of the feeds that are never pruned, e.g. the feeds of the source file
+}
+
+// PruneResult counts the pruned rows
+type PruneResult struct {
+	Feeds     int64
+	Items     int64
+	Revisions int64
+	Ratings   int64
+}
+
+// Empty reports if nothing was pruned
+func (r PruneResult) Empty() bool {
+	return r.Feeds == 0 && r.Items == 0 && r.Revisions == 0 && r.Ratings == 0
+}
+
+// Prune deletes the feeds and items outside of the retention policy
+func (d *Database) Prune(policy RetentionPolicy, now time.Time) (PruneResult, error) {
+	res := PruneResult{}
+
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		if policy.Grace > 0 {
+			// feeds that were only requested via the proxy
+			stale := tx.Model(&Feed{}).Select("id").
+				Where("COALESCE(fetched_at, updated_at) < ?", now.Add(-policy.Grace))
+			if len(policy.KeepFeeds) > 0 {
+				stale = stale.Where("url NOT IN ?", policy.KeepFeeds)
+			}
+
+			var ids []uint
+			if err := stale.Find(&ids).Error; err != nil {
+				return err
+			}
+
+			if len(ids) > 0 {
+				if err := tx.Where("feed_id IN ?", ids).Delete(&FeedItem{}).Error; err != nil {
+					return err
+				}
+				result := tx.Unscoped().Delete(&Feed{}, ids)
+				if result.Error != nil {
+					return result.Error
+				}
+				res.Feeds = result.RowsAffected
+			}
+		}
+
+		current := tx.Model(&FeedItem{}).Select("item_id").Where("item_id IS NOT NULL")
+		var changed []string // urls of the feeds with pruned items
+		prune := func(query string, args ...any) error {
+			var urls []string
+			err := tx.Model(&Item{}).
+				Where("id NOT IN (?)", current).
+				Where(query, args...).
+				Distinct().Pluck("feed_url", &urls).Error
+			if err != nil || len(urls) == 0 {
+				return err
+			}
+			changed = append(changed, urls...)
+
+			result := tx.Unscoped().
+				Where("id NOT IN (?)", current).
+				Where(query, args...).
+				Delete(&Item{})
+			res.Items += result.RowsAffected
+			return result.Error
+		}
+
+		if policy.Grace > 0 {
+			if err := prune("COALESCE(last_seen_at, created_at) < ?", now.Add(-policy.Grace)); err != nil {
+				return err
+			}
+		}
+
+		if policy.MaxAge > 0 {
+			if err := prune("created_at < ?", now.Add(-policy.MaxAge)); err != nil {
+				return err
+			}
+		}
+
+		if policy.MaxItemsPerFeed > 0 {
+			ranked := tx.Table("(?) AS ranked",
+				tx.Model(&Item{}).Select("id, ROW_NUMBER() OVER (PARTITION BY feed_url ORDER BY id DESC) AS n")).
+				Select("id").
+				Where("n > ?", policy.MaxItemsPerFeed)
+			if err := prune("id IN (?)", ranked); err != nil {
+				return err
+			}
+		}
+
+		if len(changed) > 0 {
+			// a new version of the feeds, the renders with the pruned items are outdated
+			err := tx.Model(&Feed{}).Where("url IN ?", changed).UpdateColumn("updated_at", now).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		result := tx.Unscoped().
+			Where("item_id NOT IN (?)", tx.Model(&Item{}).Select("id")).
+			Delete(&ItemRevision{})
+		res.Revisions = result.RowsAffected
+		if result.Error != nil {
+			return result.Error
+		}
+
+		result = tx.Where("item_id NOT IN (?)", tx.Model(&Item{}).Select("id")).Delete(&Rating{})
+		res.Ratings = result.RowsAffected
+		return result.Error
+	})
+
+	return res, err
+}
+
+// Vacuum releases the space of deleted rows, only SQLite files are vacuumed
+func (d *Database) Vacuum() error {
+	if d.db.Dialector.Name() != "sqlite" {
+		return nil
+	}
+	return d.db.Exec("VACUUM").Error
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Rating is the analysis of an item by one backend of the ensemble
+type Rating struct {
+	ID               uint `gorm:"primarykey"`
+	CreatedAt        time.Time
+	ItemID           uint     `gorm:"index;not null"`
+	Fingerprint      string   `gorm:"type:text;not null;default:''"` // the analyzed content of the item
+	Backend          string   `gorm:"type:text;not null"`
+	Weight           float64  `gorm:"not null"` // reputation of the backend when it rated the item
+	Deviation        *float64 // mean distance from the consensus, nil without a consensus
+	Clickbait        *float64 // Nullable
+	Framing          *float64 // Nullable
+	PersuasiveIntent *float64 // Nullable
+	HyperStimulus    *float64 // Nullable
+}
+
+// Reputation is the trust in a backend, learned from its distance to the consensus
+type Reputation struct {
+	Backend   string  `gorm:"type:text;primaryKey"`
+	Weight    float64 `gorm:"not null"`
+	Deviation float64 `gorm:"not null"` // running mean distance from the consensus
+	Ratings   int64   `gorm:"not null"`
+	UpdatedAt time.Time
+}
+
+// CreateRatings stores the ratings of an item, the ratings of prior versions are kept
+func (d *Database) CreateRatings(ratings []Rating) error {
+	if len(ratings) == 0 {
+		return nil
+	}
+	return d.db.Create(&ratings).Error
+}
+
+// FindRatingsByItemID retrieves the ratings of an item, newest first
+func (d *Database) FindRatingsByItemID(itemID uint) ([]Rating, error) {
+	var ratings []Rating
+	err := d.db.Where("item_id = ?", itemID).Order("id DESC").Find(&ratings).Error
+	return ratings, err
+}
+
+// FindReputations retrieves the reputations of all backends that rated items
+func (d *Database) FindReputations() ([]Reputation, error) {
+	var reputations []Reputation
+	err := d.db.Order("backend").Find(&reputations).Error
+	return reputations, err
+}
+
+// UpdateReputation changes the reputation of a backend in a transaction. The row is locked,
+// so concurrent updates of the backend are applied one after the other.
+// A backend without ratings starts with the reputation passed to update.
+func (d *Database) UpdateReputation(backend string, update func(rep *Reputation)) (*Reputation, error) {
+	rep := &Reputation{}
+
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		// the first rating of the backend, a concurrent insert wins
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "backend"}},
+			DoNothing: true,
+		}).Create(&Reputation{Backend: backend, Weight: 1, UpdatedAt: time.Now()}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("backend = ?", backend).First(rep).Error
+		if err != nil {
+			return err
+		}
+
+		update(rep)
+		return tx.Save(rep).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rep, nil
+}
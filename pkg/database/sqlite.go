@@ -2,9 +2,12 @@ package database
 
 import (
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
-	"gorm.io/driver/sqlite"
+	"github.com/egandro/news-deframer/pkg/canonical"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
@@ -12,24 +15,166 @@ import (
 // Item represents the rss items
 type Item struct {
 	gorm.Model
-	Hash        string   `gorm:"type:text;uniqueIndex;not null"` // SHA-256 hash with unique index
-	FeedUrl     string   `gorm:"type:text;not null"`
-	Link        string   `gorm:"type:text;not null"`
-	Guid        string   `gorm:"type:text;not null"`
-	Title       string   `gorm:"type:text;not null"`
-	Description string   `gorm:"type:text;not null"`
-	Content     string   `gorm:"type:text;not null"`
-	Framing     *float64 `gorm:"type:real"` // Nullable
-	TitleAI     *string  `gorm:"type:text"` // Nullable
-	ReasonAI    *string  `gorm:"type:text"` // Nullable
-}
-
-// Cache represents the cached feed
-type Cache struct {
+	Hash             string     `gorm:"type:text;uniqueIndex;not null"` // SHA-256 hash with unique index
+	Fingerprint      string     `gorm:"type:text;not null;default:''"`  // SHA-256 hash of the analyzed upstream content
+	FeedUrl          string     `gorm:"type:text;not null"`
+	Link             string     `gorm:"type:text;not null"`
+	CanonicalLink    string     `gorm:"type:text;index;not null;default:''"` // set on save
+	Domain           string     `gorm:"type:text;index;not null;default:''"` // set on save
+	Guid             string     `gorm:"type:text;not null"`
+	Language         string     `gorm:"type:text;not null;default:''"`
+	Title            string     `gorm:"type:text;not null"`
+	Description      string     `gorm:"type:text;not null"`
+	Content          string     `gorm:"type:text;not null"`
+	Clickbait        *float64   // Nullable
+	Framing          *float64   // Nullable
+	PersuasiveIntent *float64   // Nullable
+	HyperStimulus    *float64   // Nullable
+	TitleAI          *string    `gorm:"type:text"` // Nullable
+	DescriptionAI    *string    `gorm:"type:text"` // Nullable
+	ReasonClickbait  *string    `gorm:"type:text"` // Nullable
+	ReasonFraming    *string    `gorm:"type:text"` // Nullable
+	ReasonPersuasive *string    `gorm:"type:text"` // Nullable
+	ReasonStimulus   *string    `gorm:"type:text"` // Nullable
+	LastSeenAt       *time.Time `gorm:"index"`     // last time the item was in an upstream feed
+}
+
+// BeforeSave sets the canonical link, this implements the gorm hook
+func (i *Item) BeforeSave(tx *gorm.DB) error {
+	i.CanonicalLink = canonical.URL(i.Link)
+	i.Domain = canonical.Domain(i.Link)
+	return nil
+}
+
+// Domain is a site with analyzed items and their average scores
+type Domain struct {
+	Name             string   `gorm:"type:text;primaryKey"`
+	Items            int64    `gorm:"not null"`
+	Clickbait        *float64 // Nullable
+	Framing          *float64 // Nullable
+	PersuasiveIntent *float64 // Nullable
+	HyperStimulus    *float64 // Nullable
+	UpdatedAt        time.Time
+}
+
+// Scores returns the average scores in a stable order
+func (d *Domain) Scores() []Score {
+	return []Score{
+		{Type: ScoreTypes[0], Score: d.Clickbait},
+		{Type: ScoreTypes[1], Score: d.Framing},
+		{Type: ScoreTypes[2], Score: d.PersuasiveIntent},
+		{Type: ScoreTypes[3], Score: d.HyperStimulus},
+	}
+}
+
+// ScoreTypes are the analyzed attributes, they are also the column names of the scores
+var ScoreTypes = []string{"clickbait", "framing", "persuasive_intent", "hyper_stimulus"}
+
+// ItemFilter selects items, empty fields match all items
+type ItemFilter struct {
+	FeedUrl   string
+	Language  string
+	Since     *time.Time // created at or after
+	Until     *time.Time // created before
+	ScoreType string     // the score thresholds apply to all attributes if empty
+	MinScore  *float64   // at least one score is >= MinScore
+	MaxScore  *float64   // no score is > MaxScore
+	BeforeID  uint       // cursor, items with a lower id
+	Limit     int
+}
+
+// ItemRevision is a prior version of an item, stored when the upstream content changed
+type ItemRevision struct {
 	gorm.Model
-	FeedUrl string `gorm:"type:text;uniqueIndex;not null"`
-	Title   string `gorm:"type:text;not null"`
-	Cache   string `gorm:"type:text;not null"`
+	ItemID           uint     `gorm:"index;not null"`
+	Fingerprint      string   `gorm:"type:text;not null"`
+	Title            string   `gorm:"type:text;not null"`
+	Description      string   `gorm:"type:text;not null"`
+	Content          string   `gorm:"type:text;not null"`
+	Clickbait        *float64 // Nullable
+	Framing          *float64 // Nullable
+	PersuasiveIntent *float64 // Nullable
+	HyperStimulus    *float64 // Nullable
+	TitleAI          *string  `gorm:"type:text"` // Nullable
+	DescriptionAI    *string  `gorm:"type:text"` // Nullable
+	ReasonClickbait  *string  `gorm:"type:text"` // Nullable
+	ReasonFraming    *string  `gorm:"type:text"` // Nullable
+	ReasonPersuasive *string  `gorm:"type:text"` // Nullable
+	ReasonStimulus   *string  `gorm:"type:text"` // Nullable
+}
+
+// Score is an analyzed attribute of an item
+type Score struct {
+	Type   string
+	Score  *float64
+	Reason *string
+}
+
+// Scores returns the analyzed attributes in a stable order
+func (i *Item) Scores() []Score {
+	return []Score{
+		{Type: ScoreTypes[0], Score: i.Clickbait, Reason: i.ReasonClickbait},
+		{Type: ScoreTypes[1], Score: i.Framing, Reason: i.ReasonFraming},
+		{Type: ScoreTypes[2], Score: i.PersuasiveIntent, Reason: i.ReasonPersuasive},
+		{Type: ScoreTypes[3], Score: i.HyperStimulus, Reason: i.ReasonStimulus},
+	}
+}
+
+// Score returns the score of an attribute, nil if it is missing or unknown
+func (i *Item) Score(scoreType string) *float64 {
+	for _, score := range i.Scores() {
+		if score.Type == scoreType {
+			return score.Score
+		}
+	}
+	return nil
+}
+
+// MaxScore returns the highest score, nil if the item has no scores
+func (i *Item) MaxScore() *float64 {
+	var res *float64
+	for _, score := range i.Scores() {
+		if score.Score == nil {
+			continue
+		}
+		if res == nil || *score.Score > *res {
+			res = score.Score
+		}
+	}
+	return res
+}
+
+// Feed status after the last update
+const (
+	FeedStatusOK     = "ok"
+	FeedStatusFailed = "failed"
+)
+
+// Feed represents an upstream feed
+type Feed struct {
+	gorm.Model
+	Url          string     `gorm:"type:text;uniqueIndex;not null"`
+	Title        string     `gorm:"type:text;not null"`
+	Link         string     `gorm:"type:text;not null;default:''"`
+	Description  string     `gorm:"type:text;not null;default:''"`
+	Language     string     `gorm:"type:text;not null;default:''"`
+	Metadata     string     `gorm:"type:text;not null;default:''"` // upstream feed without items as JSON
+	ETag         string     `gorm:"type:text;not null;default:''"` // validators for conditional requests
+	LastModified string     `gorm:"type:text;not null;default:''"`
+	FetchedAt    *time.Time // last successful update, nil if the feed was never fetched
+	Status       string     `gorm:"type:text;not null;default:''"`
+	Error        string     `gorm:"type:text;not null;default:''"` // error of the last failed update
+}
+
+// FeedItem is an item of a feed at its position
+type FeedItem struct {
+	ID       uint   `gorm:"primaryKey"`
+	FeedID   uint   `gorm:"uniqueIndex:idx_feed_position;not null"`
+	Position int    `gorm:"uniqueIndex:idx_feed_position;not null"`
+	ItemID   *uint  // nil if the item failed or was skipped
+	Item     *Item  `gorm:"constraint:OnDelete:SET NULL"`
+	Skipped  bool   `gorm:"not null;default:false"` // not analyzed yet, e.g. above the token budget
+	Upstream string `gorm:"type:text;not null"`     // upstream item as JSON
 }
 
 // Database handles DB operations
@@ -37,27 +182,34 @@ type Database struct {
 	db *gorm.DB
 }
 
-// NewDatabase initializes a new SQLite database
-func NewDatabase(dbPath string) (*Database, error) {
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+// NewDatabase initializes a new database, a postgres:// url selects PostgreSQL, anything else is a SQLite file.
+// Pending migrations are applied, a database migrated by a newer program is refused.
+func NewDatabase(dsn string) (*Database, error) {
+	d, err := OpenDatabase(dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	// Auto-migrate to create table with constraints
-	err = db.AutoMigrate(&Item{}, &Cache{})
+	version, err := d.SchemaVersion()
 	if err != nil {
 		return nil, err
 	}
 
-	// Explicitly ensure unique index on Hash
-	err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_hash ON items(hash)").Error
+	if version > LatestSchemaVersion() {
+		return nil, fmt.Errorf("%w: version %v, supported %v", ErrSchemaTooNew, version, LatestSchemaVersion())
+	}
+
+	err = d.Migrate(LatestSchemaVersion())
 	if err != nil {
 		return nil, err
 	}
 
-	// Explicitly ensure unique index on FeedUrl
-	err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_feed_url ON caches(feed_url)").Error
+	return d, nil
+}
+
+// OpenDatabase connects to a database without migrating it
+func OpenDatabase(dsn string) (*Database, error) {
+	db, err := open(dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -70,17 +222,17 @@ func (d *Database) CreateItem(item *Item) error {
 	return d.db.Transaction(func(tx *gorm.DB) error {
 
 		// Try insert with ON CONFLICT DO NOTHING
-		err := tx.Clauses(clause.OnConflict{
+		result := tx.Clauses(clause.OnConflict{
 			Columns:   []clause.Column{{Name: "hash"}},
 			DoNothing: true,
-		}).Create(item).Error
+		}).Create(item)
 
-		if err != nil {
-			return err
+		if result.Error != nil {
+			return result.Error
 		}
 
 		// If no row inserted, fetch existing record
-		if tx.RowsAffected == 0 {
+		if result.RowsAffected == 0 {
 			if err := tx.Where("hash = ?", item.Hash).First(item).Error; err != nil {
 				return err
 			}
@@ -108,36 +260,215 @@ func (d *Database) FindItemByHash(hash string) (*Item, error) {
 	return &item, nil
 }
 
-// CreateCache inserts or replaces a cache entry for the given FeedUrl.
-func (d *Database) CreateCache(cache *Cache) error {
-	return d.db.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "feed_url"}}, // unique constraint column
-		UpdateAll: true,                                // update all fields on conflict
-	}).Create(cache).Error
+// FindItemsByLinks retrieves the items by their canonical links, newest first
+func (d *Database) FindItemsByLinks(canonicalLinks []string) ([]Item, error) {
+	var items []Item
+	err := d.db.
+		Where("canonical_link IN ?", canonicalLinks).
+		Order("id DESC").
+		Find(&items).Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// FindItems retrieves the items matching the filter, newest first
+func (d *Database) FindItems(filter ItemFilter) ([]Item, error) {
+	query := d.db.Order("id DESC")
+
+	if filter.FeedUrl != "" {
+		query = query.Where("feed_url = ?", filter.FeedUrl)
+	}
+
+	if filter.Language != "" {
+		query = query.Where("language = ?", filter.Language)
+	}
+
+	if filter.Since != nil {
+		query = query.Where("created_at >= ?", *filter.Since)
+	}
+
+	if filter.Until != nil {
+		query = query.Where("created_at < ?", *filter.Until)
+	}
+
+	columns := ScoreTypes
+	if filter.ScoreType != "" {
+		if !slices.Contains(ScoreTypes, filter.ScoreType) {
+			return nil, fmt.Errorf("unknown score type %q", filter.ScoreType)
+		}
+		columns = []string{filter.ScoreType}
+	}
+
+	if filter.MinScore != nil {
+		conditions := []string{}
+		values := []any{}
+		for _, column := range columns {
+			conditions = append(conditions, column+" >= ?")
+			values = append(values, *filter.MinScore)
+		}
+		query = query.Where("("+strings.Join(conditions, " OR ")+")", values...)
+	}
+
+	if filter.MaxScore != nil {
+		for _, column := range columns {
+			query = query.Where("("+column+" IS NULL OR "+column+" <= ?)", *filter.MaxScore)
+		}
+	}
+
+	if filter.BeforeID > 0 {
+		query = query.Where("id < ?", filter.BeforeID)
+	}
+
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var items []Item
+	err := query.Find(&items).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
 }
 
-func (d *Database) FindCacheByFeedUrl(feedUrl string, maxAge time.Duration) (*Cache, error) {
-	var cache Cache
-	cutoff := time.Now().Add(-maxAge)
+// ReviseItem replaces the item with the same hash, the prior version is kept as revision
+func (d *Database) ReviseItem(item *Item) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		var old Item
+		if err := tx.Where("hash = ?", item.Hash).First(&old).Error; err != nil {
+			return err
+		}
+
+		revision := &ItemRevision{
+			ItemID:           old.ID,
+			Fingerprint:      old.Fingerprint,
+			Title:            old.Title,
+			Description:      old.Description,
+			Content:          old.Content,
+			Clickbait:        old.Clickbait,
+			Framing:          old.Framing,
+			PersuasiveIntent: old.PersuasiveIntent,
+			HyperStimulus:    old.HyperStimulus,
+			TitleAI:          old.TitleAI,
+			DescriptionAI:    old.DescriptionAI,
+			ReasonClickbait:  old.ReasonClickbait,
+			ReasonFraming:    old.ReasonFraming,
+			ReasonPersuasive: old.ReasonPersuasive,
+			ReasonStimulus:   old.ReasonStimulus,
+		}
+		if err := tx.Create(revision).Error; err != nil {
+			return err
+		}
+
+		item.ID = old.ID
+		item.CreatedAt = old.CreatedAt
+		return tx.Save(item).Error
+	})
+}
+
+// SetItemFingerprint stores the fingerprint of an item without revising it
+func (d *Database) SetItemFingerprint(item *Item, fingerprint string) error {
+	item.Fingerprint = fingerprint
+	return d.db.Model(item).Update("fingerprint", fingerprint).Error
+}
+
+// FindRevisionsByItemID retrieves the prior versions of an item, oldest first
+func (d *Database) FindRevisionsByItemID(itemID uint) ([]ItemRevision, error) {
+	var revisions []ItemRevision
 	err := d.db.
-		Where("feed_url = ? AND updated_at >= ?", feedUrl, cutoff).
-		First(&cache).Error
+		Where("item_id = ?", itemID).
+		Order("id").
+		Find(&revisions).Error
 
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			// No matching record found, return nil without error
-			return nil, nil
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// RefreshDomains rebuilds the domains from the items
+func (d *Database) RefreshDomains() error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM domains").Error; err != nil {
+			return err
 		}
-		// Other errors should be returned
+
+		return tx.Exec(`INSERT INTO domains (name, items, clickbait, framing, persuasive_intent, hyper_stimulus, updated_at)
+			SELECT domain, COUNT(*), AVG(clickbait), AVG(framing), AVG(persuasive_intent), AVG(hyper_stimulus), ?
+			FROM items WHERE domain <> '' AND deleted_at IS NULL GROUP BY domain`, time.Now()).Error
+	})
+}
+
+// FindAllDomains retrieves the domains sorted by name
+func (d *Database) FindAllDomains() ([]Domain, error) {
+	var domains []Domain
+	err := d.db.Order("name").Find(&domains).Error
+	if err != nil {
 		return nil, err
 	}
 
-	return &cache, nil
+	return domains, nil
+}
+
+// SaveFeed inserts or replaces the feed with the same url and its items
+func (d *Database) SaveFeed(feed *Feed, items []FeedItem) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		var previous Feed
+		err := tx.Where("url = ?", feed.Url).First(&previous).Error
+		switch {
+		case err == nil:
+			feed.ID = previous.ID
+			feed.CreatedAt = previous.CreatedAt
+			err = tx.Save(feed).Error
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			err = tx.Create(feed).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Where("feed_id = ?", feed.ID).Delete(&FeedItem{}).Error; err != nil {
+			return err
+		}
+
+		if len(items) == 0 {
+			return nil
+		}
+
+		for i := range items {
+			items[i].ID = 0
+			items[i].FeedID = feed.ID
+			items[i].Position = i
+		}
+
+		// the items are stored already
+		if err := tx.Omit("Item").Create(&items).Error; err != nil {
+			return err
+		}
+
+		return markSeen(tx, feed.ID, time.Now())
+	})
 }
 
-func (d *Database) FindCacheByID(id uint) (*Cache, error) {
-	var cache Cache
-	err := d.db.First(&cache, id).Error
+// markSeen sets the last seen time of the items of a feed
+func markSeen(tx *gorm.DB, feedID uint, seenAt time.Time) error {
+	return tx.Model(&Item{}).
+		Where("id IN (?)", tx.Model(&FeedItem{}).Select("item_id").Where("feed_id = ?", feedID)).
+		UpdateColumn("last_seen_at", seenAt).Error
+}
+
+// FindFeedByUrl retrieves a feed by its url
+func (d *Database) FindFeedByUrl(feedUrl string) (*Feed, error) {
+	var feed Feed
+	err := d.db.
+		Where("url = ?", feedUrl).
+		First(&feed).Error
 
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -148,13 +479,12 @@ func (d *Database) FindCacheByID(id uint) (*Cache, error) {
 		return nil, err
 	}
 
-	return &cache, nil
+	return &feed, nil
 }
 
-func (d *Database) FindAllCaches() ([]Cache, error) {
-	var caches []Cache
-	err := d.db.
-		Find(&caches).Error
+func (d *Database) FindFeedByID(id uint) (*Feed, error) {
+	var feed Feed
+	err := d.db.First(&feed, id).Error
 
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -165,5 +495,73 @@ func (d *Database) FindAllCaches() ([]Cache, error) {
 		return nil, err
 	}
 
-	return caches, nil
+	return &feed, nil
+}
+
+func (d *Database) FindAllFeeds() ([]Feed, error) {
+	var feeds []Feed
+	err := d.db.
+		Order("id").
+		Find(&feeds).Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	return feeds, nil
+}
+
+// FindFeedItems retrieves the items of a feed in their order, with the analyzed items
+func (d *Database) FindFeedItems(feedID uint) ([]FeedItem, error) {
+	var items []FeedItem
+	err := d.db.
+		Preload("Item").
+		Where("feed_id = ?", feedID).
+		Order("position").
+		Find(&items).Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// HasPendingFeedItems reports if a feed has items without an analysis, i.e. failed or skipped items
+func (d *Database) HasPendingFeedItems(feedID uint) (bool, error) {
+	var count int64
+	err := d.db.Model(&FeedItem{}).
+		Where("feed_id = ? AND item_id IS NULL", feedID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// TouchFeed marks a feed and its items as up to date
+func (d *Database) TouchFeed(feed *Feed) error {
+	now := time.Now()
+	feed.FetchedAt = &now
+	feed.Status = FeedStatusOK
+	feed.Error = ""
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(feed).Updates(map[string]any{
+			"fetched_at": feed.FetchedAt,
+			"status":     feed.Status,
+			"error":      feed.Error,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return markSeen(tx, feed.ID, now)
+	})
+}
+
+// SetFeedError records a failed update of an existing feed, its items are kept
+func (d *Database) SetFeedError(feedUrl string, feedErr error) error {
+	return d.db.Model(&Feed{}).
+		Where("url = ?", feedUrl).
+		Updates(map[string]any{
+			"status": FeedStatusFailed,
+			"error":  feedErr.Error(),
+		}).Error
 }
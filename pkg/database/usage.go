@@ -0,0 +1,74 @@
+package database
+
+import (
+	"time"
+)
+
+// AICall is a chat completion of an AI backend
+type AICall struct {
+	ID               uint `gorm:"primarykey"`
+	CreatedAt        time.Time
+	Day              string   `gorm:"type:text;index;not null"` // UTC date, e.g. 2025-01-31
+	FeedUrl          string   `gorm:"type:text;not null;default:''"`
+	Model            string   `gorm:"type:text;not null"`
+	PromptTokens     int64    `gorm:"not null"`
+	CompletionTokens int64    `gorm:"not null"`
+	LatencyMs        int64    `gorm:"not null"`
+	Failed           bool     `gorm:"not null"`
+	Cost             *float64 // Nullable, missing without a price of the model
+}
+
+// Usage is the sum of the AI calls of a feed and model on a day
+type Usage struct {
+	Day              string
+	FeedUrl          string
+	Model            string
+	Calls            int64
+	FailedCalls      int64
+	PromptTokens     int64
+	CompletionTokens int64
+	AverageLatencyMs float64
+	Cost             *float64 // Nullable, missing if no call had a price
+}
+
+// Day returns the UTC date of a time as stored in AICall.Day
+func Day(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// CreateAICall stores an AI call, the day is set from the creation time
+func (d *Database) CreateAICall(call *AICall) error {
+	if call.CreatedAt.IsZero() {
+		call.CreatedAt = time.Now()
+	}
+	call.Day = Day(call.CreatedAt)
+	return d.db.Create(call).Error
+}
+
+// TokensOnDay returns the prompt and completion tokens of all AI calls of a day
+func (d *Database) TokensOnDay(day string) (int64, error) {
+	var tokens int64
+	err := d.db.Model(&AICall{}).
+		Select("COALESCE(SUM(prompt_tokens + completion_tokens), 0)").
+		Where("day = ?", day).
+		Scan(&tokens).Error
+	return tokens, err
+}
+
+// FindUsage aggregates the AI calls per day, feed and model, newest day first
+func (d *Database) FindUsage(since string) ([]Usage, error) {
+	var usage []Usage
+	err := d.db.Model(&AICall{}).
+		Select(`day, feed_url, model,
+			COUNT(*) AS calls,
+			SUM(CASE WHEN failed THEN 1 ELSE 0 END) AS failed_calls,
+			SUM(prompt_tokens) AS prompt_tokens,
+			SUM(completion_tokens) AS completion_tokens,
+			AVG(latency_ms) AS average_latency_ms,
+			SUM(cost) AS cost`).
+		Where("day >= ?", since).
+		Group("day, feed_url, model").
+		Order("day DESC, feed_url, model").
+		Scan(&usage).Error
+	return usage, err
+}
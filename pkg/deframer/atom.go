@@ -0,0 +1,86 @@
+package deframer
+
+import (
+	"encoding/xml"
+
+	"github.com/gorilla/feeds"
+)
+
+// deframerAtom is an atom feed with the upstream metadata and a deframer:group per entry
+type deframerAtom struct {
+	*feeds.Atom
+	extra     *feedExtra
+	annotated bool // add the deframer:group elements
+}
+
+type deframerAtomFeed struct {
+	*feeds.AtomFeed
+	DeframerNamespace string                 `xml:"xmlns:deframer,attr,omitempty"`
+	Namespaces        []xml.Attr             `xml:",any,attr"`
+	Categories        []deframerAtomCategory `xml:"category"`
+	Extensions        []extensionElement     `xml:",omitempty"`
+	Entries           []*deframerAtomEntry   `xml:"entry"`
+}
+
+type deframerAtomEntry struct {
+	*feeds.AtomEntry
+	Categories []deframerAtomCategory `xml:"category"`
+	Extensions []extensionElement     `xml:",omitempty"`
+	Group      *deframerGroup         `xml:"deframer:group,omitempty"`
+}
+
+type deframerAtomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// FeedXml returns the xml representation, this implements feeds.XmlFeed
+func (a *deframerAtom) FeedXml() interface{} {
+	atomFeed := a.AtomFeed()
+	if a.Id != "" {
+		atomFeed.Id = a.Id
+	}
+
+	res := &deframerAtomFeed{
+		AtomFeed:   atomFeed,
+		Namespaces: a.extra.namespaceAttrs(),
+		Categories: newAtomCategories(a.extra.categories),
+		Extensions: a.extra.extensions,
+	}
+	if a.annotated {
+		res.DeframerNamespace = Namespace
+	}
+
+	for i, entry := range atomFeed.Entries {
+		extra := a.extra.item(i)
+
+		// the first enclosure is added by gorilla/feeds
+		for _, enclosure := range extra.enclosures[min(1, len(extra.enclosures)):] {
+			entry.Links = append(entry.Links, feeds.AtomLink{
+				Href:   enclosure.URL,
+				Rel:    "enclosure",
+				Type:   enclosure.Type,
+				Length: enclosure.Length,
+			})
+		}
+
+		current := &deframerAtomEntry{
+			AtomEntry:  entry,
+			Categories: newAtomCategories(extra.categories),
+			Extensions: extra.extensions,
+		}
+		if a.annotated {
+			current.Group = extra.group
+		}
+		res.Entries = append(res.Entries, current)
+	}
+
+	return res
+}
+
+func newAtomCategories(categories []string) []deframerAtomCategory {
+	res := []deframerAtomCategory{}
+	for _, category := range categories {
+		res = append(res, deframerAtomCategory{Term: category})
+	}
+	return res
+}
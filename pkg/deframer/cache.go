@@ -0,0 +1,81 @@
+package deframer
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/egandro/news-deframer/pkg/database"
+)
+
+// maxRenders is the number of rendered feeds kept in memory
+const maxRenders = 256
+
+// renderCache keeps the recently rendered feeds in memory
+type renderCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+}
+
+type renderEntry struct {
+	key   string
+	value string
+}
+
+func newRenderCache(max int) *renderCache {
+	return &renderCache{
+		max:     max,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *renderCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*renderEntry).value, true
+}
+
+func (c *renderCache) put(key string, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*renderEntry).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&renderEntry{key: key, value: value})
+
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*renderEntry).key)
+	}
+}
+
+// renderKey identifies a rendered feed, a new version of the feed has a new key
+func renderKey(feed *database.Feed, opts FeedOptions) string {
+	maxScore := ""
+	if opts.MaxScore != nil {
+		maxScore = fmt.Sprint(*opts.MaxScore)
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = FormatRSS
+	}
+
+	return fmt.Sprintf("%v|%v|%v|%v|%v|%v|%v", feed.ID, feed.UpdatedAt.UnixNano(),
+		maxScore, opts.ScoreType, opts.Placeholder, opts.Embedded, format)
+}
@@ -4,11 +4,17 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/avast/retry-go"
+	"github.com/egandro/news-deframer/pkg/canonical"
 	"github.com/egandro/news-deframer/pkg/config"
 	"github.com/egandro/news-deframer/pkg/database"
 	"github.com/egandro/news-deframer/pkg/downloader"
@@ -17,136 +23,641 @@ import (
 	"github.com/gorilla/feeds"
 	"github.com/mmcdole/gofeed"
 	"goa.design/clue/log"
+	"golang.org/x/sync/singleflight"
 )
 
 const maxAge = time.Minute * 90
 
+// ErrInvalidURL is returned when a feed url can't be proxied
+var ErrInvalidURL = errors.New("invalid url")
+
+// ErrUnknownLanguage is returned when a new feed is proxied with a language without a prompt
+var ErrUnknownLanguage = errors.New("no prompt for the language")
+
+// ErrNoPrompt is returned for items that are not analyzed, there is no prompt for the language of the feed
+var ErrNoPrompt = errors.New("no prompt for the language of the feed")
+
+// FeedOptions controls how a deframed feed is rendered
+type FeedOptions struct {
+	MaxScore    *float64 // items with a higher score are filtered
+	ScoreType   string   // MaxScore applies to this attribute, to the highest score if empty
+	Placeholder bool     // replace the filtered items with a summary item
+	Embedded    bool     // replace title and content instead of keeping the original
+	Format      Format   // rss if empty
+}
+
 type deframer struct {
-	ctx        context.Context
-	db         *database.Database
-	ai         openai.OpenAI
-	src        *source.Source
-	downloader downloader.Downloader
-	prompts    map[string]source.Prompt
+	ctx         context.Context
+	db          *database.Database
+	ai          openai.Backend // the default backend, nil if AI_MODEL is not set
+	aiDefaults  backendDefaults
+	sourceFile  string
+	settings    atomic.Pointer[settings] // replaced on reload
+	downloader  downloader.Downloader
+	proxy       downloader.Downloader // downloads the feeds that are not in the source file
+	proxied     singleflight.Group    // updates of the proxied feeds by canonical url
+	updates     *feedLocks            // updates of a feed never overlap
+	workers     chan struct{}         // limits the items deframed at once
+	tolerant    bool                  // pass failed items through and skip failed feeds
+	renders     *renderCache
+	retention   database.RetentionPolicy
+	dailyTokens int64 // AI tokens per UTC day, 0 is unlimited
+	vacuum      bool  // vacuum the database after pruning
 }
 
 type Deframer interface {
-	UpdateFeeds() (int, error)
-	DeframeFeed(parsedData *gofeed.Feed, feed source.Feed) (string, error)
-	DeframeItem(item *gofeed.Item, feed source.Feed) (*gofeed.Item, error)
-	FindAllCaches() ([]database.Cache, error)
-	FindCacheByID(id uint) (*database.Cache, error)
+	UpdateFeeds() (*UpdateReport, error)
+	UpdateFeed(feed source.Feed) error
+	Feeds() []source.Feed
+	DeframeURL(feedUrl string, lang string, opts FeedOptions) (string, error)
+	DeframeFeed(parsedData *gofeed.Feed, feed source.Feed, opts FeedOptions) (string, error)
+	DeframeItem(item *gofeed.Item, feed source.Feed) (*database.Item, error)
+	FindAllFeeds() ([]database.Feed, error)
+	FindFeedByID(id uint) (*database.Feed, error)
+	FindItems(filter database.ItemFilter) ([]database.Item, error)
+	LookupURLs(urls []string) ([]*database.Item, error)
+	FindAllDomains() ([]database.Domain, error)
+	FindUsage(since time.Time) ([]database.Usage, error)
+	RenderFeed(feed *database.Feed, opts FeedOptions) (string, error)
+	Prune() (database.PruneResult, error)
+	Reload() error
+}
+
+// settings are the feeds, prompts and backends of the source file
+type settings struct {
+	src      *source.Source
+	prompts  map[string]source.Prompt
+	backends map[string]openai.Backend
+	ensemble []openai.Backend // rate every item, replaces the backends of the feeds and prompts
+}
+
+// backendDefaults apply to the backends of the source file
+type backendDefaults struct {
+	output      openai.OutputMode
+	timeout     time.Duration
+	concurrency int
+}
+
+func newSettings(src *source.Source) *settings {
+	if src == nil {
+		src = &source.Source{}
+	}
+
+	prompts := make(map[string]source.Prompt)
+	for _, prompt := range src.Prompts {
+		prompts[prompt.Language] = prompt
+	}
+
+	return &settings{src: src, prompts: prompts, backends: map[string]openai.Backend{}}
+}
+
+// loadSettings connects the backends of the source file
+func (d *deframer) loadSettings(src *source.Source) (*settings, error) {
+	res := newSettings(src)
+
+	for _, b := range res.src.Backends {
+		key, err := b.APIKey()
+		if err != nil {
+			return nil, err
+		}
+
+		// validated by the source
+		timeout, _ := b.RequestTimeout()
+		if timeout == 0 {
+			timeout = d.aiDefaults.timeout
+		}
+
+		output := openai.OutputMode(b.Output)
+		if output == "" {
+			output = d.aiDefaults.output
+		}
+
+		concurrency := b.Concurrency
+		if concurrency == 0 {
+			concurrency = d.aiDefaults.concurrency
+		}
+
+		ai := openai.NewLimitedAI(openai.NewAI(b.URL, b.Model, key, output), concurrency)
+		res.backends[b.Name] = openai.NewBackend(b.Name, ai, timeout)
+	}
+
+	if res.src.Ensemble != nil {
+		for _, name := range res.src.Ensemble.Backends {
+			if name == source.DefaultBackend && d.ai != nil {
+				res.ensemble = append(res.ensemble, d.ai)
+			} else if b, ok := res.backends[name]; ok {
+				res.ensemble = append(res.ensemble, b)
+			}
+		}
+	}
+
+	if d.ai == nil {
+		if len(res.backends) == 0 {
+			return nil, errors.New("no AI backend, set AI_MODEL or add backends to the source file")
+		}
+
+		for _, names := range res.assignments() {
+			if slices.Contains(names, source.DefaultBackend) {
+				return nil, fmt.Errorf("backend %q is not configured, set AI_MODEL", source.DefaultBackend)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// assignments returns the backends assigned to the feeds, prompts and the ensemble
+func (s *settings) assignments() [][]string {
+	res := [][]string{}
+	for _, feed := range s.src.Feeds {
+		res = append(res, feed.Backends)
+	}
+	for _, prompt := range s.src.Prompts {
+		res = append(res, prompt.Backends)
+	}
+	if s.src.Ensemble != nil {
+		res = append(res, s.src.Ensemble.Backends)
+	}
+	return res
 }
 
-// NewDeframer initializes a new deframer
+// NewDeframer initializes a new deframer. It is shared by all services,
+// the context is used for logging and cancels running updates.
 func NewDeframer(ctx context.Context) (Deframer, error) {
 	cfg, err := config.GetConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	db, err := database.NewDatabase(cfg.DatabaseFile)
+	db, err := database.NewDatabase(cfg.DSN())
 	if err != nil {
 		return nil, err
 	}
 
-	ai := openai.NewAI(cfg.AI_URL, cfg.AI_Model, "")
-
 	src, err := source.ParseFile(cfg.Source)
 	if err != nil {
 		return nil, err
 	}
 
-	downloader := downloader.NewDownloader()
+	aiDefaults := backendDefaults{
+		output:      openai.OutputMode(cfg.AI_Output),
+		timeout:     cfg.AI_Timeout,
+		concurrency: cfg.AI_Concurrency,
+	}
 
-	prompts := make(map[string]source.Prompt)
-	for _, prompt := range src.Prompts {
-		prompts[prompt.Language] = prompt
+	var ai openai.Backend
+	if cfg.AI_Model != "" {
+		key, err := cfg.APIKey()
+		if err != nil {
+			return nil, err
+		}
+		ai = openai.NewBackend(source.DefaultBackend,
+			openai.NewLimitedAI(openai.NewAI(cfg.AI_URL, cfg.AI_Model, key, aiDefaults.output), aiDefaults.concurrency),
+			aiDefaults.timeout)
 	}
 
 	res := &deframer{
 		ctx:        ctx,
 		db:         db,
 		ai:         ai,
-		src:        src,
-		downloader: downloader,
-		prompts:    prompts,
+		aiDefaults: aiDefaults,
+		sourceFile: cfg.Source,
+		downloader: downloader.NewDownloader(cfg.FeedMaxSize),
+		proxy:      downloader.NewProxyDownloader(cfg.FeedMaxSize),
+		workers:    make(chan struct{}, max(cfg.Workers, 1)),
+		tolerant:   cfg.TolerateErrors,
+		renders:    newRenderCache(maxRenders),
+		updates:    newFeedLocks(),
+		retention: database.RetentionPolicy{
+			MaxAge:          cfg.RetentionAge,
+			MaxItemsPerFeed: cfg.RetentionItems,
+			Grace:           cfg.PruneGrace,
+		},
+		vacuum:      cfg.Vacuum,
+		dailyTokens: cfg.AI_DailyTokens,
+	}
+
+	settings, err := res.loadSettings(src)
+	if err != nil {
+		return nil, err
 	}
+	res.settings.Store(settings)
 
 	return res, nil
 }
 
-func (d *deframer) UpdateFeeds() (int, error) {
-	numberOfDownloads := 0
-	parser := gofeed.NewParser()
+// Reload reads the source file again. The feeds, prompts and backends are replaced at once,
+// an invalid file is reported and the current ones are kept.
+func (d *deframer) Reload() error {
+	src, err := source.ParseFile(d.sourceFile)
+	if err != nil {
+		return fmt.Errorf("invalid source file %q: %w", d.sourceFile, err)
+	}
+
+	settings, err := d.loadSettings(src)
+	if err != nil {
+		return fmt.Errorf("invalid source file %q: %w", d.sourceFile, err)
+	}
 
-	for _, feed := range d.src.Feeds {
-		cache, err := d.db.FindCacheByFeedUrl(feed.RSS_URL, maxAge)
+	d.settings.Store(settings)
+	return nil
+}
+
+// UpdateFeeds updates all feeds with an outdated cache. Failed feeds are skipped
+// unless errors are not tolerated, feeds with a running update are skipped.
+func (d *deframer) UpdateFeeds() (*UpdateReport, error) {
+	report := &UpdateReport{}
+
+	for _, feed := range d.Feeds() {
+		previous, err := d.db.FindFeedByUrl(feed.RSS_URL)
 		if err != nil {
-			return numberOfDownloads, err
+			return report, err
 		}
 
-		if cache != nil {
+		if isFresh(previous) {
+			report.Feeds = append(report.Feeds, FeedReport{
+				FeedUrl: feed.RSS_URL,
+				Skipped: true,
+			})
 			continue
 		}
 
-		data, err := d.downloader.DownloadRSSFeed(feed.RSS_URL)
-		if err != nil {
-			return numberOfDownloads, err
+		if !d.updates.tryLock(feed.RSS_URL) {
+			report.Feeds = append(report.Feeds, FeedReport{
+				FeedUrl: feed.RSS_URL,
+				Skipped: true,
+			})
+			continue
 		}
+		feedReport := d.updateFeed(feed)
+		d.updates.unlock(feed.RSS_URL)
+		report.Feeds = append(report.Feeds, feedReport.FeedReport)
 
-		parsedData, err := parser.ParseString(string(data))
+		if feedReport.Err != nil {
+			if !d.tolerant || d.ctx.Err() != nil {
+				return report, feedReport.Err
+			}
+			// keep the previous cache
+			log.Errorf(d.ctx, feedReport.Err, "can't update %q", feed.RSS_URL)
+		}
+	}
+
+	return report, d.db.RefreshDomains()
+}
+
+// UpdateFeed downloads and deframes a feed, regardless of the age of the cache.
+// ErrUpdateRunning is returned if the feed is updated already.
+func (d *deframer) UpdateFeed(feed source.Feed) error {
+	if !d.updates.tryLock(feed.RSS_URL) {
+		return fmt.Errorf("%w: %q", ErrUpdateRunning, feed.RSS_URL)
+	}
+	feedReport := d.updateFeed(feed)
+	d.updates.unlock(feed.RSS_URL)
+	if feedReport.Err != nil {
+		return feedReport.Err
+	}
+
+	return d.db.RefreshDomains()
+}
+
+// Feeds returns the feeds of the source file
+func (d *deframer) Feeds() []source.Feed {
+	return d.settings.Load().src.Feeds
+}
+
+// DeframeURL deframes an arbitrary upstream feed. The feed is cached by its url, the language only
+// applies to new feeds. Concurrent requests of a feed share the update.
+func (d *deframer) DeframeURL(feedUrl string, lang string, opts FeedOptions) (string, error) {
+	u, err := url.Parse(feedUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		// never proxy local files
+		return "", fmt.Errorf("%w: %q", ErrInvalidURL, feedUrl)
+	}
+
+	feed, dbFeed, err := d.proxiedFeed(canonical.FeedURL(feedUrl), lang)
+	if err != nil {
+		return "", err
+	}
+
+	if !isFresh(dbFeed) {
+		res, err, _ := d.proxied.Do(feed.RSS_URL, func() (any, error) {
+			// waits for a running update of the scheduler
+			if err := d.updates.lock(d.ctx, feed.RSS_URL); err != nil {
+				return nil, err
+			}
+			defer d.updates.unlock(feed.RSS_URL)
+
+			// updated in the meantime
+			dbFeed, err := d.db.FindFeedByUrl(feed.RSS_URL)
+			if err != nil || isFresh(dbFeed) {
+				return dbFeed, err
+			}
+
+			feedReport := d.updateFeed(feed)
+			return feedReport.feed, feedReport.Err
+		})
+		if errors.Is(err, downloader.ErrNotPublic) {
+			return "", fmt.Errorf("%w: %w", ErrInvalidURL, err)
+		}
 		if err != nil {
-			return numberOfDownloads, err
+			return "", err
+		}
+
+		dbFeed = res.(*database.Feed)
+	}
+
+	return d.RenderFeed(dbFeed, opts)
+}
+
+// proxiedFeed returns the feed of a proxy request and the stored feed, nil if it is new.
+// The feeds of the source file and stored feeds keep their language, a new feed needs a language
+// with a prompt or the language of the upstream feed.
+func (d *deframer) proxiedFeed(feedUrl string, lang string) (source.Feed, *database.Feed, error) {
+	feed := source.Feed{RSS_URL: feedUrl}
+	known := false
+	for _, f := range d.Feeds() {
+		if canonical.FeedURL(f.RSS_URL) == feedUrl {
+			feed = f
+			known = true
+			break
 		}
+	}
+
+	dbFeed, err := d.db.FindFeedByUrl(feed.RSS_URL)
+	if err != nil {
+		return feed, nil, err
+	}
 
-		title := parsedData.Title
-		if title == "" {
-			// some fallback
-			title = feed.RSS_URL
+	switch {
+	case known:
+	case dbFeed != nil:
+		feed.Language = dbFeed.Language
+	case lang != "":
+		if _, ok := d.findPrompt(lang); !ok {
+			return feed, nil, fmt.Errorf("%w: %q", ErrUnknownLanguage, lang)
 		}
+		feed.Language = lang
+	}
+
+	return feed, dbFeed, nil
+}
+
+// RenderFeed renders a stored feed with the given options
+func (d *deframer) RenderFeed(feed *database.Feed, opts FeedOptions) (string, error) {
+	key := renderKey(feed, opts)
+	if res, ok := d.renders.get(key); ok {
+		return res, nil
+	}
+
+	parsedData, dbItems, skipped, err := d.loadFeed(feed)
+	if err != nil {
+		return "", err
+	}
 
-		title = fmt.Sprintf("%v (%v)", title, feed.Language)
+	res, err := renderFeed(parsedData, dbItems, skipped, opts)
+	if err != nil {
+		return "", err
+	}
 
-		unframed, err := d.DeframeFeed(parsedData, feed)
+	d.renders.put(key, res)
+	return res, nil
+}
+
+// loadFeed restores the upstream feed and the analyzed items, failed and skipped items are nil
+func (d *deframer) loadFeed(feed *database.Feed) (*gofeed.Feed, []*database.Item, []bool, error) {
+	parsedData := &gofeed.Feed{
+		Title:       feed.Title,
+		Link:        feed.Link,
+		Description: feed.Description,
+		Language:    feed.Language,
+	}
+
+	if feed.Metadata != "" {
+		if err := json.Unmarshal([]byte(feed.Metadata), parsedData); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	feedItems, err := d.db.FindFeedItems(feed.ID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	dbItems := []*database.Item{}
+	skipped := []bool{}
+	for _, feedItem := range feedItems {
+		item := &gofeed.Item{}
+		if err := json.Unmarshal([]byte(feedItem.Upstream), item); err != nil {
+			return nil, nil, nil, err
+		}
+		parsedData.Items = append(parsedData.Items, item)
+		dbItems = append(dbItems, feedItem.Item)
+		skipped = append(skipped, feedItem.Skipped)
+	}
+
+	return parsedData, dbItems, skipped, nil
+}
+
+// isFresh returns true if the feed was updated successfully within maxAge
+func isFresh(feed *database.Feed) bool {
+	return feed != nil && feed.FetchedAt != nil && time.Since(*feed.FetchedAt) < maxAge
+}
+
+// downloaderFor returns the proxy downloader for feeds that are not in the source file
+func (d *deframer) downloaderFor(feed source.Feed) downloader.Downloader {
+	for _, f := range d.Feeds() {
+		if f.RSS_URL == feed.RSS_URL {
+			return d.downloader
+		}
+	}
+	return d.proxy
+}
+
+// updatedFeed is the result of updateFeed
+type updatedFeed struct {
+	FeedReport
+	feed *database.Feed
+}
+
+// updateFeed downloads and deframes the feed and stores it with its items.
+// A failure is recorded with the feed, the previous items are kept.
+func (d *deframer) updateFeed(feed source.Feed) *updatedFeed {
+	res := d.fetchFeed(feed)
+
+	if res.Err != nil && d.ctx.Err() == nil {
+		err := d.db.SetFeedError(feed.RSS_URL, res.Err)
 		if err != nil {
-			return numberOfDownloads, err
+			log.Errorf(d.ctx, err, "can't store the status of %q", feed.RSS_URL)
 		}
+	}
+
+	return res
+}
+
+func (d *deframer) fetchFeed(feed source.Feed) *updatedFeed {
+	res := &updatedFeed{
+		FeedReport: FeedReport{FeedUrl: feed.RSS_URL},
+	}
 
-		cache = &database.Cache{
-			FeedUrl: feed.RSS_URL,
-			Title:   title,
-			Cache:   unframed,
+	previous, err := d.db.FindFeedByUrl(feed.RSS_URL)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	validators := downloader.Validators{}
+	if previous != nil {
+		// a not modified feed would keep the failed and skipped items, they are analyzed again
+		pending, err := d.db.HasPendingFeedItems(previous.ID)
+		if err != nil {
+			res.Err = err
+			return res
+		}
+		if !pending {
+			validators.ETag = previous.ETag
+			validators.LastModified = previous.LastModified
 		}
+	}
+
+	download, err := d.downloaderFor(feed).DownloadRSSFeedConditional(feed.RSS_URL, validators)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	if download.NotModified && previous != nil {
+		// nothing to do
+		res.NotModified = true
+		res.Err = d.db.TouchFeed(previous)
+		res.feed = previous
+		return res
+	}
 
-		err = d.db.CreateCache(cache)
+	data := download.Data
+
+	parsedData, err := gofeed.NewParser().ParseString(data)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	title := parsedData.Title
+	if title == "" {
+		// some fallback
+		title = feed.RSS_URL
+	}
+
+	language := feed.Language
+	if language == "" {
+		language = parsedData.Language
+	}
+
+	title = fmt.Sprintf("%v (%v)", title, language)
+
+	feed.Language = language
+	if feed.Title == "" {
+		feed.Title = parsedData.Title
+	}
+	dbItems, skipped, failed, err := d.deframeItems(parsedData.Items, feed)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	res.Items = len(parsedData.Items)
+	res.FailedItems = failed
+
+	feedItems := []database.FeedItem{}
+	for i, item := range parsedData.Items {
+		upstream, err := json.Marshal(item)
 		if err != nil {
-			return numberOfDownloads, err
+			res.Err = err
+			return res
+		}
+
+		feedItem := database.FeedItem{Upstream: string(upstream), Skipped: skipped[i]}
+		if dbItems[i] != nil {
+			feedItem.ItemID = &dbItems[i].ID
+		}
+		if skipped[i] {
+			res.SkippedItems++
 		}
+		feedItems = append(feedItems, feedItem)
+	}
+
+	// the items are stored separately
+	metadata := *parsedData
+	metadata.Items = nil
+	metadataJSON, err := json.Marshal(&metadata)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	now := time.Now()
+	dbFeed := &database.Feed{
+		Url:          feed.RSS_URL,
+		Title:        title,
+		Link:         parsedData.Link,
+		Description:  parsedData.Description,
+		Language:     language,
+		Metadata:     string(metadataJSON),
+		ETag:         download.Validators.ETag,
+		LastModified: download.Validators.LastModified,
+		FetchedAt:    &now,
+		Status:       database.FeedStatusOK,
+	}
+
+	err = d.db.SaveFeed(dbFeed, feedItems)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	res.feed = dbFeed
+	return res
+}
+
+func (d *deframer) DeframeFeed(parsedData *gofeed.Feed, feed source.Feed, opts FeedOptions) (string, error) {
+	res, _, err := d.deframeFeed(parsedData, feed, opts)
+	return res, err
+}
 
-		numberOfDownloads++
+// deframeFeed renders the deframed feed and returns the number of items that failed
+func (d *deframer) deframeFeed(parsedData *gofeed.Feed, feed source.Feed, opts FeedOptions) (string, int, error) {
+	if feed.Language == "" {
+		// use the language of the feed
+		feed.Language = parsedData.Language
 	}
-	return numberOfDownloads, nil
+	if feed.Title == "" {
+		feed.Title = parsedData.Title
+	}
+
+	dbItems, skipped, failed, err := d.deframeItems(parsedData.Items, feed)
+	if err != nil {
+		return "", failed, err
+	}
+
+	res, err := renderFeed(parsedData, dbItems, skipped, opts)
+	return res, failed, err
 }
 
-func (d *deframer) DeframeFeed(parsedData *gofeed.Feed, feed source.Feed) (string, error) {
+// renderFeed renders the upstream feed with the analyzed items, failed and skipped items are nil
+func renderFeed(parsedData *gofeed.Feed, dbItems []*database.Item, skipped []bool, opts FeedOptions) (string, error) {
 	// Update channel title with prefix
 	prefix := "[Deframed] "
-	parsedData.Title = prefix + parsedData.Title
 
 	newFeed := &feeds.Feed{
-		Title: parsedData.Title,
+		Title: prefix + parsedData.Title,
 		Link: &feeds.Link{
 			Href: parsedData.Link,
 			Type: parsedData.FeedType,
 		},
 		Description: parsedData.Description,
 		Author:      &feeds.Author{},
-		// // Id:
-		// // Subtitle:
-		// // Items:
-		Copyright: parsedData.Copyright,
-		// Image:
+		Id:          parsedData.FeedLink,
+		Subtitle:    parsedData.Description,
+		Copyright:   parsedData.Copyright,
 	}
 
 	if parsedData.Author != nil {
@@ -180,94 +691,254 @@ func (d *deframer) DeframeFeed(parsedData *gofeed.Feed, feed source.Feed) (strin
 	// }
 	// newFeed.Add(item)
 
-	for _, current := range parsedData.Items {
-		deframed, err := d.DeframeItem(current, feed)
-		if err != nil {
-			// maybe just continue?
-			return "", err
+	extra := newFeedExtra(parsedData)
+	hidden := []*gofeed.Item{}
+
+	for i, current := range parsedData.Items {
+		dbItem := dbItems[i]
+
+		if dbItem == nil {
+			// the item failed - pass it through
+			dbItem = &database.Item{
+				Title:       current.Title,
+				Description: current.Description,
+				Content:     current.Content,
+			}
+		}
+
+		if opts.hides(dbItem) {
+			hidden = append(hidden, current)
+			continue
 		}
 
 		item := &feeds.Item{
-			Title:       deframed.Title,
-			Link:        &feeds.Link{Href: deframed.Link},
-			Description: deframed.Description,
-			Content:     deframed.Content,
-			Id:          deframed.GUID,
+			Title:       current.Title,
+			Link:        &feeds.Link{Href: current.Link},
+			Description: current.Description,
+			Content:     current.Content,
+			Id:          current.GUID,
+		}
+
+		if len(current.Enclosures) > 0 {
+			item.Enclosure = newEnclosure(current.Enclosures[0])
 		}
 
-		if deframed.PublishedParsed != nil {
-			item.Created = *deframed.PublishedParsed
+		if opts.Embedded {
+			embed(item, dbItem)
 		}
 
-		if deframed.UpdatedParsed != nil {
-			item.Updated = *deframed.UpdatedParsed
+		if current.PublishedParsed != nil {
+			item.Created = *current.PublishedParsed
 		}
 
-		if len(deframed.Authors) > 0 {
+		if current.UpdatedParsed != nil {
+			item.Updated = *current.UpdatedParsed
+		}
+
+		if len(current.Authors) > 0 {
 			item.Author = &feeds.Author{
-				Name:  deframed.Authors[0].Name,
-				Email: deframed.Authors[0].Email,
+				Name:  current.Authors[0].Name,
+				Email: current.Authors[0].Email,
 			}
 		}
 
 		newFeed.Add(item)
+
+		group := passedDeframerGroup(skipped[i])
+		if dbItems[i] != nil {
+			group = newDeframerGroup(dbItem)
+		}
+		extra.items = append(extra.items, newItemExtra(current, group))
 	}
 
-	result, err := newFeed.ToRss()
-	if err != nil {
-		return "", err
+	if opts.Placeholder && len(hidden) > 0 {
+		newFeed.Add(placeholderItem(parsedData, hidden, opts))
+		extra.items = append(extra.items, &itemExtra{})
 	}
 
-	return result, nil
+	return render(newFeed, extra, opts)
 }
 
-func (d *deframer) DeframeItem(item *gofeed.Item, feed source.Feed) (*gofeed.Item, error) {
-	key := fmt.Sprintf("%v-%v", feed.RSS_URL, item.GUID)
-	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+// deframeItems deframes the items in parallel, the result has the same order as the items.
+// Items passed through are nil: the skipped items, which are flagged because the daily token budget
+// is used up or there is no prompt, and if errors are tolerated the failed items, which are counted.
+func (d *deframer) deframeItems(items []*gofeed.Item, feed source.Feed) ([]*database.Item, []bool, int, error) {
+	res := make([]*database.Item, len(items))
+	skipped := make([]bool, len(items))
+	errs := make([]error, len(items))
+
+	var wg sync.WaitGroup
+
+	for i, current := range items {
+		// wait for a free worker
+		select {
+		case d.workers <- struct{}{}:
+		case <-d.ctx.Done():
+			wg.Wait()
+			return nil, nil, 0, d.ctx.Err()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-d.workers
+				wg.Done()
+			}()
+			res[i], errs[i] = d.DeframeItem(current, feed)
+		}()
+	}
+
+	wg.Wait()
+
+	if err := d.ctx.Err(); err != nil {
+		return nil, nil, 0, err
+	}
 
-	dbItem, err := d.db.FindItemByHash(hash)
+	// items above the budget or without a prompt are passed through regardless of the tolerance,
+	// they are analyzed on a later update
+	for _, reason := range []error{ErrBudgetExceeded, ErrNoPrompt} {
+		passed := 0
+		for i, err := range errs {
+			if errors.Is(err, reason) {
+				errs[i] = nil
+				skipped[i] = true
+				passed++
+			}
+		}
+		if passed > 0 {
+			log.Printf(d.ctx, "%v items of %q passed through: %v", passed, feed.RSS_URL, reason)
+		}
+	}
+
+	if !d.tolerant {
+		if err := errors.Join(errs...); err != nil {
+			return nil, nil, 0, err
+		}
+		return res, skipped, 0, nil
+	}
+
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			log.Errorf(d.ctx, err, "can't deframe item %q of %q", items[i].GUID, feed.RSS_URL)
+			res[i] = nil
+			failed++
+		}
+	}
+
+	return res, skipped, failed, nil
+}
+
+func (d *deframer) DeframeItem(item *gofeed.Item, feed source.Feed) (*database.Item, error) {
+	hash := itemHash(feed, item)
+	fingerprint := itemFingerprint(item)
+
+	found, err := d.db.FindItemByHash(hash)
 	if err != nil {
 		return nil, err
 	}
 
-	if dbItem != nil {
-		item.Link = dbItem.Link
-		item.GUID = dbItem.Guid
-		item.Title = dbItem.Title
-		item.Description = dbItem.Description
-		item.Content = dbItem.Content
-		return item, nil
+	if found != nil && found.Fingerprint == "" {
+		// analyzed before fingerprints existed - adopt the current content
+		err = d.db.SetItemFingerprint(found, fingerprint)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	dbItem, err = d.deframeItemInternal(item, feed)
+	if found != nil && found.Fingerprint == fingerprint {
+		return found, nil
+	}
+
+	dbItem, ratings, err := d.deframeItemInternal(item, feed)
 	if err != nil {
 		return nil, err
 	}
 
 	dbItem.Hash = hash
-	err = d.db.CreateItem(dbItem)
+	dbItem.FeedUrl = feed.RSS_URL
+	dbItem.Language = feed.Language
+	dbItem.Fingerprint = fingerprint
+
+	if found != nil {
+		// the upstream content changed - re-analyzed, keep the prior version
+		err = d.db.ReviseItem(dbItem)
+	} else {
+		err = d.db.CreateItem(dbItem)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ratings {
+		ratings[i].ItemID = dbItem.ID
+		ratings[i].Fingerprint = fingerprint
+	}
+	if err := d.db.CreateRatings(ratings); err != nil {
+		return nil, err
+	}
+
+	return dbItem, nil
+}
+
+// itemHash identifies an item of a feed
+func itemHash(feed source.Feed, item *gofeed.Item) string {
+	key := fmt.Sprintf("%v-%v", feed.RSS_URL, item.GUID)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+// itemFingerprint identifies the analyzed content of an item, a change triggers a re-analysis
+func itemFingerprint(item *gofeed.Item) string {
+	key := strings.Join([]string{item.Title, item.Description, item.Published, item.Updated}, "\n")
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+func (d *deframer) FindAllFeeds() ([]database.Feed, error) {
+	return d.db.FindAllFeeds()
+}
+
+func (d *deframer) FindItems(filter database.ItemFilter) ([]database.Item, error) {
+	return d.db.FindItems(filter)
+}
+
+// LookupURLs finds the newest item per page url, the result has the same order as the urls.
+// Unknown urls are nil.
+func (d *deframer) LookupURLs(urls []string) ([]*database.Item, error) {
+	links := make([]string, len(urls))
+	for i, u := range urls {
+		links[i] = canonical.URL(u)
+	}
+
+	items, err := d.db.FindItemsByLinks(links)
 	if err != nil {
 		return nil, err
 	}
 
-	item.Link = dbItem.Link
-	item.GUID = dbItem.Guid
-	item.Title = dbItem.Title
-	item.Description = dbItem.Description
-	item.Content = dbItem.Content
+	// items are sorted newest first
+	byLink := map[string]*database.Item{}
+	for i := range items {
+		if _, ok := byLink[items[i].CanonicalLink]; !ok {
+			byLink[items[i].CanonicalLink] = &items[i]
+		}
+	}
+
+	res := make([]*database.Item, len(urls))
+	for i, link := range links {
+		res[i] = byLink[link]
+	}
 
-	return item, err
+	return res, nil
 }
 
-func (d *deframer) FindAllCaches() ([]database.Cache, error) {
-	return d.db.FindAllCaches()
+func (d *deframer) FindAllDomains() ([]database.Domain, error) {
+	return d.db.FindAllDomains()
 }
 
-func (d *deframer) FindCacheByID(id uint) (*database.Cache, error) {
-	return d.db.FindCacheByID(id)
+func (d *deframer) FindFeedByID(id uint) (*database.Feed, error) {
+	return d.db.FindFeedByID(id)
 }
 
-func (d *deframer) deframeItemInternal(item *gofeed.Item, feed source.Feed) (*database.Item, error) {
+func (d *deframer) deframeItemInternal(item *gofeed.Item, feed source.Feed) (*database.Item, []database.Rating, error) {
 	res := &database.Item{
 		Link:        item.Link,
 		Guid:        item.GUID,
@@ -276,83 +947,180 @@ func (d *deframer) deframeItemInternal(item *gofeed.Item, feed source.Feed) (*da
 		Content:     item.Content,
 	}
 
-	if _, ok := d.prompts[feed.Language]; !ok {
-		// we don't know this language
-		return res, nil
+	prompt, ok := d.findPrompt(feed.Language)
+	if !ok {
+		// we don't know this language, the item is analyzed once there is a prompt
+		return nil, nil, fmt.Errorf("%w: %q", ErrNoPrompt, feed.Language)
+	}
+
+	user, system, err := prompt.Render(promptData(item, feed))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := d.checkBudget(); err != nil {
+		return nil, nil, err
+	}
+
+	var analysis *openai.Analysis
+	var ratings []database.Rating
+
+	ctx := d.usageContext(feed)
+	if s := d.settings.Load(); len(s.ensemble) > 0 {
+		analysis, ratings, err = d.rate(ctx, s.ensemble, s.src.Ensemble.MinRatings(), user, system)
+	} else {
+		analysis, err = d.analyze(ctx, d.aiFor(feed, prompt), item, feed, user, system)
 	}
 
-	prompt := d.prompts[feed.Language]
-	user := prompt.User
-	system := prompt.System
+	if err != nil {
+		// the item is not stored, so it is analyzed again on the next update
+		return nil, nil, err
+	}
 
-	user = strings.ReplaceAll(user, "$TITLE", item.Title)
-	user = strings.ReplaceAll(user, "$DESCRIPTION", item.Description)
+	if analysis != nil {
+		res.TitleAI = analysis.TitleCorrected
+		res.DescriptionAI = analysis.DescriptionCorrected
 
-	system = strings.ReplaceAll(system, "$TITLE", item.Title)
-	system = strings.ReplaceAll(system, "$DESCRIPTION", item.Description)
+		res.Clickbait = analysis.Clickbait
+		res.Framing = analysis.Framing
+		res.PersuasiveIntent = analysis.PersuasiveIntent
+		res.HyperStimulus = analysis.HyperStimulus
+
+		res.ReasonClickbait = analysis.ReasonClickbait
+		res.ReasonFraming = analysis.ReasonFraming
+		res.ReasonPersuasive = analysis.ReasonPersuasive
+		res.ReasonStimulus = analysis.ReasonStimulus
+	}
 
+	return res, ratings, nil
+}
+
+// promptData returns the context of the prompt templates
+func promptData(item *gofeed.Item, feed source.Feed) source.PromptData {
+	res := source.PromptData{
+		Title:       source.Text(item.Title),
+		Description: source.Text(item.Description),
+		Content:     source.Text(item.Content),
+		Link:        source.Text(item.Link),
+		Published:   source.Text(item.Published),
+		FeedTitle:   source.Text(feed.Title),
+		Language:    source.Text(feed.Language),
+	}
+
+	for _, category := range item.Categories {
+		res.Categories = append(res.Categories, source.Text(category))
+	}
+
+	if len(item.Authors) > 0 && item.Authors[0] != nil {
+		res.Author = source.Text(item.Authors[0].Name)
+	}
+
+	return res
+}
+
+// analyze asks the backends of the feed, an invalid or failed answer is asked again
+func (d *deframer) analyze(ctx context.Context, ai openai.OpenAI, item *gofeed.Item, feed source.Feed, user string, system string) (*openai.Analysis, error) {
 	const maxRetry = 3
-	var resultAny interface{}
+	var analysis *openai.Analysis
 
 	err := retry.Do(
 		func() error {
-			resultString, err := d.ai.Query(d.ctx, user, system)
-			if err != nil {
-				return err
-			}
-
-			// this is guessing - run the Query again until the result is ok
-			resultAny, err = d.ai.FuzzyParseJSON(resultString)
-			if err != nil {
-				return err
-			}
-
-			return nil
+			var err error
+			analysis, err = ai.Analyze(ctx, user, system)
+			return err
 		},
 		retry.Attempts(maxRetry),
+		retry.RetryIf(func(err error) bool {
+			return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+		}),
+		retry.OnRetry(func(n uint, err error) {
+			log.Printf(d.ctx, "retrying item %q of %q: %v", item.GUID, feed.RSS_URL, err)
+		}),
+		retry.LastErrorOnly(true),
 	)
 
-	if err != nil {
-		//return nil, err
-		// only log - don't fail
-		log.Error(d.ctx, err)
+	return analysis, err
+}
+
+// embed replaces the title with the corrected title and prepends the scores and reasons
+func embed(item *feeds.Item, dbItem *database.Item) {
+	maxScore := dbItem.MaxScore()
+	if dbItem.TitleAI == nil || *dbItem.TitleAI == "" || maxScore == nil || *maxScore <= 0.0 {
+		return
 	}
 
-	title_corrected := ""
-	reason := ""
-	var framing float64
+	summary := reasonSummary(dbItem)
 
-	if resultMap, ok := resultAny.(map[string]any); ok {
-		if v, ok := resultMap["title_corrected"]; ok {
-			if d, ok := v.(string); ok {
-				title_corrected = d
-			}
+	item.Title = fmt.Sprintf("Score: %v - %v", *maxScore, *dbItem.TitleAI)
+	item.Description = summary + item.Description
+	if item.Content != "" {
+		item.Content = fmt.Sprintf("Original title: %v <br/> %v%v", dbItem.Title, summary, item.Content)
+	}
+}
+
+// reasonSummary returns the reasons of all scores, e.g. "Framing: 0.5 - reason <br/> "
+func reasonSummary(item *database.Item) string {
+	var sb strings.Builder
+	for _, score := range item.Scores() {
+		if score.Score == nil {
+			continue
 		}
-		if v, ok := resultMap["framing"]; ok {
-			if d, ok := v.(json.Number); ok {
-				f, err := d.Float64()
-				if err == nil {
-					framing = f
-				}
-			}
+		reason := ""
+		if score.Reason != nil {
+			reason = *score.Reason
 		}
-		if v, ok := resultMap["reason"]; ok {
-			if d, ok := v.(string); ok {
-				reason = d
-			}
+		fmt.Fprintf(&sb, "%v: %v - %v <br/> ", score.Type, *score.Score, reason)
+	}
+	return sb.String()
+}
+
+// aiFor returns the backends of the feed, or else of the prompt, in failover order.
+// Without assignments the default backend is used, or else all backends of the source file.
+func (d *deframer) aiFor(feed source.Feed, prompt source.Prompt) openai.OpenAI {
+	s := d.settings.Load()
+
+	names := feed.Backends
+	if len(names) == 0 {
+		names = prompt.Backends
+	}
+	if len(names) == 0 {
+		if d.ai != nil {
+			return d.ai
+		}
+		for _, b := range s.src.Backends {
+			names = append(names, b.Name)
 		}
 	}
 
-	if title_corrected != "" && framing > 0.0 {
-		res.TitleAI = &title_corrected
-		res.Framing = &framing
-		res.ReasonAI = &reason
-		title := fmt.Sprintf("Framing: %v - %v", framing, title_corrected)
-		if res.Content != "" {
-			res.Content = fmt.Sprintf("Original title: %v <br/> Reason: %v <br/> %v", res.Title, reason, res.Content)
+	backends := make([]openai.Backend, 0, len(names))
+	for _, name := range names {
+		if name == source.DefaultBackend {
+			if d.ai != nil {
+				backends = append(backends, d.ai)
+			}
+		} else if b, ok := s.backends[name]; ok {
+			backends = append(backends, b)
 		}
-		res.Title = title
 	}
 
-	return res, nil
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	return openai.NewRouter(backends...)
+}
+
+// findPrompt returns the prompt for a language tag, e.g. "de-DE" falls back to "de"
+func (d *deframer) findPrompt(language string) (source.Prompt, bool) {
+	prompts := d.settings.Load().prompts
+	if prompt, ok := prompts[language]; ok {
+		return prompt, true
+	}
+
+	base, _, found := strings.Cut(language, "-")
+	if !found {
+		return source.Prompt{}, false
+	}
+
+	prompt, ok := prompts[strings.ToLower(base)]
+	return prompt, ok
 }
@@ -3,7 +3,14 @@ package deframer
 import (
 	"context"
 	_ "embed"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/egandro/news-deframer/pkg/database"
 	"github.com/egandro/news-deframer/pkg/downloader"
@@ -11,6 +18,7 @@ import (
 	"github.com/egandro/news-deframer/pkg/openai"
 	"github.com/egandro/news-deframer/pkg/openai/mock_openai"
 	"github.com/egandro/news-deframer/pkg/source"
+	"github.com/gorilla/feeds"
 	"github.com/mmcdole/gofeed"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/mock/gomock"
@@ -32,21 +40,17 @@ func setupTestDeframer(t *testing.T, ai openai.OpenAI, src *source.Source, downl
 		t.Fatalf("Failed to create test database: %v", err)
 	}
 
-	prompts := make(map[string]source.Prompt)
-	if src != nil {
-		for _, prompt := range src.Prompts {
-			prompts[prompt.Language] = prompt
-		}
-	}
-
 	res := &deframer{
 		ctx:        ctx,
 		db:         db,
-		ai:         ai,
-		src:        src,
+		ai:         openai.NewBackend(source.DefaultBackend, ai, 0),
 		downloader: downloader,
-		prompts:    prompts,
+		proxy:      downloader,
+		workers:    make(chan struct{}, 4),
+		renders:    newRenderCache(maxRenders),
+		updates:    newFeedLocks(),
 	}
+	res.settings.Store(newSettings(src))
 
 	return res, nil
 }
@@ -70,14 +74,12 @@ func TestNewUpdateFeeds(t *testing.T) {
 	defer ctrl.Finish()
 
 	openAIMock := mock_openai.NewMockOpenAI(ctrl)
-	openAIMock.EXPECT().Query(gomock.Any(), gomock.Any(), gomock.Any()).
-		Return("", nil).Times(3)
-	openAIMock.EXPECT().FuzzyParseJSON(gomock.Any()).
-		Return(nil, nil).Times(3)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&openai.Analysis{}, nil).Times(3)
 
 	source, err := source.ParseString(sourceContent)
 	downloaderMock := mock_downloader.NewMockDownloader(ctrl)
-	downloaderMock.EXPECT().DownloadRSSFeed(gomock.Any()).Return(rssContent, nil).Times(1)
+	downloaderMock.EXPECT().DownloadRSSFeedConditional(gomock.Any(), gomock.Any()).Return(&downloader.Download{Data: rssContent}, nil).Times(1)
 
 	d, err := setupTestDeframer(t, openAIMock, source, downloaderMock)
 
@@ -85,15 +87,22 @@ func TestNewUpdateFeeds(t *testing.T) {
 	assert.NotNil(t, d, "Deframer should be initialized")
 
 	expected := 1
-	count, err := d.UpdateFeeds()
+	report, err := d.UpdateFeeds()
+	assert.NoError(t, err)
+	assert.Equal(t, report.Updated(), expected)
+
+	// the domains are refreshed after the update
+	domains, err := d.FindAllDomains()
 	assert.NoError(t, err)
-	assert.Equal(t, count, expected)
+	assert.Len(t, domains, 1)
+	assert.Equal(t, "example.com", domains[0].Name)
+	assert.Equal(t, int64(3), domains[0].Items)
 
 	// 2nd call - it should take the data from the cache
 	expected = 0
-	count, err = d.UpdateFeeds()
+	report, err = d.UpdateFeeds()
 	assert.NoError(t, err)
-	assert.Equal(t, count, expected)
+	assert.Equal(t, report.Updated(), expected)
 }
 
 func TestDeframe(t *testing.T) {
@@ -101,10 +110,8 @@ func TestDeframe(t *testing.T) {
 	defer ctrl.Finish()
 
 	openAIMock := mock_openai.NewMockOpenAI(ctrl)
-	openAIMock.EXPECT().Query(gomock.Any(), gomock.Any(), gomock.Any()).
-		Return("", nil).Times(3)
-	openAIMock.EXPECT().FuzzyParseJSON(gomock.Any()).
-		Return(nil, nil).Times(3)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&openai.Analysis{}, nil).Times(3)
 
 	source, err := source.ParseString(sourceContent)
 	d, err := setupTestDeframer(t, openAIMock, source, nil)
@@ -116,7 +123,7 @@ func TestDeframe(t *testing.T) {
 	parsedData, err := parser.ParseString(string(rssContent))
 	assert.NoError(t, err)
 
-	str, err := d.DeframeFeed(parsedData, source.Feeds[0])
+	str, err := d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{})
 	assert.NoError(t, err)
 	assert.NotEmpty(t, str, "")
 }
@@ -133,14 +140,11 @@ func TestDeframeItem(t *testing.T) {
 	}
 	`
 
-	openAI := openai.NewAI("", "", "dummy")
-	fuzzy, errFuzzy := openAI.FuzzyParseJSON(jsonString)
+	analysis, errAnalysis := openai.ParseAnalysis(jsonString)
 
 	openAIMock := mock_openai.NewMockOpenAI(ctrl)
-	openAIMock.EXPECT().Query(gomock.Any(), gomock.Any(), gomock.Any()).
-		Return(jsonString, nil).Times(1)
-	openAIMock.EXPECT().FuzzyParseJSON(gomock.Any()).
-		Return(fuzzy, errFuzzy).Times(1)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(analysis, errAnalysis).Times(1)
 	source, err := source.ParseString(sourceContent)
 	d, err := setupTestDeframer(t, openAIMock, source, nil)
 
@@ -155,3 +159,1047 @@ func TestDeframeItem(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotEmpty(t, str, "")
 }
+
+func TestDeframeItemChanged(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	jsonString := `{ "title_corrected": "dummy title", "framing": 0.2, "reason": "My Reason" }`
+
+	analysis, errAnalysis := openai.ParseAnalysis(jsonString)
+
+	// analyzed again after the headline was edited
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(analysis, errAnalysis).Times(2)
+	source, err := source.ParseString(sourceContent)
+	d, err := setupTestDeframer(t, openAIMock, source, nil)
+	assert.NoError(t, err)
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(string(rssContent))
+	assert.NoError(t, err)
+
+	item := parsedData.Items[0]
+	first, err := d.DeframeItem(item, source.Feeds[0])
+	assert.NoError(t, err)
+
+	// unchanged - served from the database
+	_, err = d.DeframeItem(item, source.Feeds[0])
+	assert.NoError(t, err)
+
+	item.Title = "Edited Title"
+	second, err := d.DeframeItem(item, source.Feeds[0])
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, second.ID)
+	assert.NotEqual(t, first.Fingerprint, second.Fingerprint)
+
+	revisions, err := d.(*deframer).db.FindRevisionsByItemID(first.ID)
+	assert.NoError(t, err)
+	assert.Len(t, revisions, 1)
+	assert.Equal(t, first.Fingerprint, revisions[0].Fingerprint)
+}
+
+func TestLookupURLs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	jsonString := `{ "title_corrected": "dummy title", "framing": 0.2, "reason": "My Reason" }`
+
+	analysis, errAnalysis := openai.ParseAnalysis(jsonString)
+
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(analysis, errAnalysis).Times(1)
+	source, err := source.ParseString(sourceContent)
+	d, err := setupTestDeframer(t, openAIMock, source, nil)
+	assert.NoError(t, err)
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(string(rssContent))
+	assert.NoError(t, err)
+
+	item, err := d.DeframeItem(parsedData.Items[0], source.Feeds[0])
+	assert.NoError(t, err)
+
+	items, err := d.LookupURLs([]string{
+		"http://example.com/item/link1/?utm_source=rss#top",
+		"https://www.example.com/item/unknown",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, items, 2)
+	assert.NotNil(t, items[0])
+	assert.Equal(t, item.ID, items[0].ID)
+	assert.Nil(t, items[1], "Unknown url should be nil")
+}
+
+func TestDeframeURL(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the items are analyzed only once
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&openai.Analysis{}, nil).Times(3)
+
+	source, err := source.ParseString(sourceContent)
+	downloaderMock := mock_downloader.NewMockDownloader(ctrl)
+	downloaderMock.EXPECT().DownloadRSSFeedConditional("https://example.com/rss", gomock.Any()).Return(&downloader.Download{Data: rssContent}, nil).Times(1)
+
+	d, err := setupTestDeframer(t, openAIMock, source, downloaderMock)
+	assert.NoError(t, err)
+
+	str, err := d.DeframeURL("https://example.com/rss", "dummy", FeedOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, str, "Item Title 2")
+
+	// 2nd call - it should take the data from the cache
+	maxScore := 0.5
+	str, err = d.DeframeURL("https://example.com/rss", "dummy", FeedOptions{MaxScore: &maxScore, Embedded: true})
+	assert.NoError(t, err)
+	assert.Contains(t, str, "Item Title 2")
+
+	dbFeeds, err := d.FindAllFeeds()
+	assert.NoError(t, err)
+	assert.Len(t, dbFeeds, 1)
+	assert.Equal(t, database.FeedStatusOK, dbFeeds[0].Status)
+
+	// local files are never proxied
+	_, err = d.DeframeURL("file:///etc/passwd", "", FeedOptions{})
+	assert.ErrorIs(t, err, ErrInvalidURL)
+
+	// the language of a known feed is kept
+	_, err = d.DeframeURL("https://example.com/rss", "", FeedOptions{})
+	assert.NoError(t, err)
+	_, err = d.DeframeURL("HTTPS://Example.com/rss#top", "de", FeedOptions{})
+	assert.NoError(t, err)
+	dbFeeds, err = d.FindAllFeeds()
+	assert.NoError(t, err)
+	assert.Len(t, dbFeeds, 1)
+	assert.Equal(t, "dummy", dbFeeds[0].Language)
+
+	// a new feed needs a language with a prompt
+	_, err = d.DeframeURL("https://example.com/other", "de", FeedOptions{})
+	assert.ErrorIs(t, err, ErrUnknownLanguage)
+
+	// without a prompt for the upstream language the items are passed through and not stored
+	downloaderMock.EXPECT().DownloadRSSFeedConditional("https://example.com/other", gomock.Any()).Return(&downloader.Download{Data: rssContent}, nil).Times(1)
+	str, err = d.DeframeURL("https://example.com/other", "", FeedOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, str, `<deframer:meta status="skipped"></deframer:meta>`)
+	items, err := d.FindItems(database.ItemFilter{FeedUrl: "https://example.com/other"})
+	assert.NoError(t, err)
+	assert.Empty(t, items, "Items without a prompt should not be stored")
+
+	// local addresses are rejected by the downloader
+	downloaderMock.EXPECT().DownloadRSSFeedConditional("http://localhost/rss", gomock.Any()).Return(nil, downloader.ErrNotPublic).Times(1)
+	_, err = d.DeframeURL("http://localhost/rss", "", FeedOptions{})
+	assert.ErrorIs(t, err, ErrInvalidURL)
+}
+
+func TestDeframeURLConcurrent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&openai.Analysis{}, nil).Times(3)
+
+	// concurrent requests share one download
+	downloaderMock := mock_downloader.NewMockDownloader(ctrl)
+	downloaderMock.EXPECT().DownloadRSSFeedConditional("https://example.com/rss", gomock.Any()).
+		DoAndReturn(func(string, downloader.Validators) (*downloader.Download, error) {
+			time.Sleep(50 * time.Millisecond)
+			return &downloader.Download{Data: rssContent}, nil
+		}).Times(1)
+
+	source, err := source.ParseString(sourceContent)
+	assert.NoError(t, err)
+	d, err := setupTestDeframer(t, openAIMock, source, downloaderMock)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for _, feedUrl := range []string{"https://example.com/rss", "https://example.com/rss", "HTTPS://Example.com:443/rss#top", "https://example.com/rss"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			str, err := d.DeframeURL(feedUrl, "dummy", FeedOptions{})
+			assert.NoError(t, err)
+			assert.Contains(t, str, "Item Title 2")
+		}()
+	}
+	wg.Wait()
+
+	// another spelling of the url is another feed
+	downloaderMock.EXPECT().DownloadRSSFeedConditional("https://www.example.com/rss/", gomock.Any()).Return(&downloader.Download{Data: rssContent}, nil).Times(1)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&openai.Analysis{}, nil).Times(3)
+	_, err = d.DeframeURL("https://www.example.com/rss/", "dummy", FeedOptions{})
+	assert.NoError(t, err)
+
+	dbFeeds, err := d.FindAllFeeds()
+	assert.NoError(t, err)
+	assert.Len(t, dbFeeds, 2)
+}
+
+func TestDeframeNamespace(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	jsonString := `{ "title_corrected": "dummy title", "framing": 0.2, "reason": "My Reason" }`
+
+	analysis, errAnalysis := openai.ParseAnalysis(jsonString)
+
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(analysis, errAnalysis).Times(3)
+	source, err := source.ParseString(sourceContent)
+	d, err := setupTestDeframer(t, openAIMock, source, nil)
+	assert.NoError(t, err)
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(string(rssContent))
+	assert.NoError(t, err)
+
+	// annotated - original title and scores in the deframer namespace
+	str, err := d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, str, `xmlns:deframer="`+Namespace+`"`)
+	assert.Contains(t, str, "<title>Item Title 2</title>")
+	assert.Contains(t, str, `<deframer:content type="framing" score="0.2">My Reason</deframer:content>`)
+
+	// embedded - no additional values
+	str, err = d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{Embedded: true})
+	assert.NoError(t, err)
+	assert.NotContains(t, str, "deframer:")
+	assert.Contains(t, str, "dummy title")
+}
+
+func TestDeframeItemScores(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	jsonString := `{
+		"title_corrected": "dummy title",
+		"description_corrected": "dummy description",
+		"clickbait": 0.3,
+		"framing": 0,
+		"hyper_stimulus": 0.1,
+		"reason_clickbait": "Clickbait Reason",
+		"reason_framing": "Framing Reason",
+		"reason_stimulus": "Stimulus Reason"
+	}`
+
+	analysis, errAnalysis := openai.ParseAnalysis(jsonString)
+
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(analysis, errAnalysis).Times(1)
+	source, err := source.ParseString(sourceContent)
+	d, err := setupTestDeframer(t, openAIMock, source, nil)
+	assert.NoError(t, err)
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(string(rssContent))
+	assert.NoError(t, err)
+
+	item, err := d.DeframeItem(parsedData.Items[0], source.Feeds[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 0.3, *item.Clickbait)
+	assert.Equal(t, 0.0, *item.Framing, "A zero score is not missing")
+	assert.Nil(t, item.PersuasiveIntent, "Missing scores are NULL")
+	assert.Equal(t, 0.1, *item.HyperStimulus)
+	assert.Equal(t, "Clickbait Reason", *item.ReasonClickbait)
+	assert.Equal(t, "Framing Reason", *item.ReasonFraming)
+	assert.Nil(t, item.ReasonPersuasive)
+	assert.Equal(t, "Stimulus Reason", *item.ReasonStimulus)
+	assert.Equal(t, "dummy description", *item.DescriptionAI)
+	assert.Equal(t, "Item Title 1", item.Title, "Original title should be stored")
+	assert.Equal(t, "<p>Desc Item 1</p>", item.Content, "Original content should be stored")
+
+	embedded := &feeds.Item{Title: item.Title, Description: item.Description, Content: item.Content}
+	embed(embedded, item)
+	assert.Equal(t, "Score: 0.3 - dummy title", embedded.Title)
+	assert.True(t, strings.HasPrefix(embedded.Description, "clickbait: 0.3 - Clickbait Reason <br/> "))
+	assert.True(t, strings.HasPrefix(embedded.Content, "Original title: Item Title 1 <br/> clickbait: 0.3"))
+}
+
+func TestDeframeModes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	jsonString := `{ "title_corrected": "dummy title", "framing": 0.2, "reason": "My Reason" }`
+
+	analysis, errAnalysis := openai.ParseAnalysis(jsonString)
+
+	// the modes are rendered from the same stored items
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(analysis, errAnalysis).Times(3)
+	source, err := source.ParseString(sourceContent)
+	d, err := setupTestDeframer(t, openAIMock, source, nil)
+	assert.NoError(t, err)
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(string(rssContent))
+	assert.NoError(t, err)
+
+	str, err := d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{Embedded: true})
+	assert.NoError(t, err)
+	assert.Contains(t, str, "<title>Score: 0.2 - dummy title</title>")
+	assert.Contains(t, str, "Original title: Item Title 1")
+	assert.NotContains(t, str, "deframer:")
+
+	str, err = d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, str, "<title>Item Title 1</title>", "Annotated mode should keep the original title")
+	assert.NotContains(t, str, "Score: 0.2")
+	assert.NotContains(t, str, "Original title")
+	assert.Contains(t, str, `<deframer:content type="framing" score="0.2">My Reason</deframer:content>`)
+}
+
+func TestDeframeFeedOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the first item takes the longest
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, user string, system string) (*openai.Analysis, error) {
+			if strings.Contains(user, "Desc Item 1") {
+				time.Sleep(20 * time.Millisecond)
+			}
+			return &openai.Analysis{}, nil
+		}).Times(3)
+
+	source, err := source.ParseString(sourceContent)
+	d, err := setupTestDeframer(t, openAIMock, source, nil)
+	assert.NoError(t, err)
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(string(rssContent))
+	assert.NoError(t, err)
+
+	str, err := d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{})
+	assert.NoError(t, err)
+
+	first := strings.Index(str, "link1")
+	second := strings.Index(str, "link2")
+	third := strings.Index(str, "link3")
+	assert.True(t, first < second && second < third, "Items should keep the original order")
+}
+
+func TestDeframeFeedCancel(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	source, err := source.ParseString(sourceContent)
+	df, err := setupTestDeframer(t, openAIMock, source, nil)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d := df.(*deframer)
+	d.ctx = ctx
+	d.workers = make(chan struct{}) // no free worker
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(string(rssContent))
+	assert.NoError(t, err)
+
+	_, err = d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDeframeFeedTolerant(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the 2nd item fails
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, user string, system string) (*openai.Analysis, error) {
+			if strings.Contains(user, "Desc Item 2") {
+				return nil, errors.New("AI failed")
+			}
+			return &openai.Analysis{}, nil
+		}).AnyTimes()
+
+	source, err := source.ParseString(sourceContent)
+	df, err := setupTestDeframer(t, openAIMock, source, nil)
+	assert.NoError(t, err)
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(string(rssContent))
+	assert.NoError(t, err)
+
+	// strict
+	_, err = df.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{})
+	assert.Error(t, err)
+
+	// tolerant
+	df.(*deframer).tolerant = true
+	str, err := df.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, str, "<title>Item Title 2</title>", "Failed item should pass through")
+	assert.Contains(t, str, `<deframer:meta status="failed">`)
+
+	// failed items are not stored
+	item, err := df.(*deframer).db.FindItemByHash(itemHash(source.Feeds[0], parsedData.Items[1]))
+	assert.NoError(t, err)
+	assert.Nil(t, item)
+}
+
+func TestUpdateFeedsReport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&openai.Analysis{}, nil).Times(3)
+
+	src, err := source.ParseString(sourceContent)
+	src.Feeds = append(src.Feeds, source.Feed{RSS_URL: "file://broken", Language: "dummy"})
+
+	downloaderMock := mock_downloader.NewMockDownloader(ctrl)
+	downloaderMock.EXPECT().DownloadRSSFeedConditional("file://dummy", gomock.Any()).Return(&downloader.Download{Data: rssContent}, nil).Times(1)
+	downloaderMock.EXPECT().DownloadRSSFeedConditional("file://broken", gomock.Any()).Return(nil, errors.New("download failed")).Times(1)
+
+	df, err := setupTestDeframer(t, openAIMock, src, downloaderMock)
+	assert.NoError(t, err)
+	df.(*deframer).tolerant = true
+
+	report, err := df.UpdateFeeds()
+	assert.NoError(t, err)
+	assert.Len(t, report.Feeds, 2)
+	assert.Equal(t, 1, report.Updated())
+	assert.Equal(t, 3, report.Feeds[0].Items)
+	assert.Equal(t, 0, report.Feeds[0].FailedItems)
+
+	failed := report.Failed()
+	assert.Len(t, failed, 1)
+	assert.Equal(t, "file://broken", failed[0].FeedUrl)
+	assert.EqualError(t, failed[0].Err, "download failed")
+}
+
+func TestUpdateFeedNotModified(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the items are analyzed only once
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&openai.Analysis{}, nil).Times(3)
+
+	src, err := source.ParseString(sourceContent)
+	validators := downloader.Validators{ETag: `"v1"`}
+
+	downloaderMock := mock_downloader.NewMockDownloader(ctrl)
+	gomock.InOrder(
+		downloaderMock.EXPECT().DownloadRSSFeedConditional("file://dummy", downloader.Validators{}).
+			Return(&downloader.Download{Data: rssContent, Validators: validators}, nil),
+		downloaderMock.EXPECT().DownloadRSSFeedConditional("file://dummy", validators).
+			Return(&downloader.Download{Validators: validators, NotModified: true}, nil),
+	)
+
+	df, err := setupTestDeframer(t, openAIMock, src, downloaderMock)
+	assert.NoError(t, err)
+
+	err = df.UpdateFeed(src.Feeds[0])
+	assert.NoError(t, err)
+
+	feedReport := df.(*deframer).updateFeed(src.Feeds[0])
+	assert.NoError(t, feedReport.Err)
+	assert.True(t, feedReport.NotModified)
+	assert.NotNil(t, feedReport.feed)
+
+	str, err := df.RenderFeed(feedReport.feed, FeedOptions{Embedded: true})
+	assert.NoError(t, err)
+	assert.Contains(t, str, "Item Title 2")
+}
+
+func TestUpdateFeedNoOverlap(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&openai.Analysis{}, nil).Times(6)
+
+	src, err := source.ParseString(sourceContent)
+	assert.NoError(t, err)
+
+	started := make(chan struct{})
+	block := make(chan struct{})
+	var unlocked atomic.Bool
+	downloaderMock := mock_downloader.NewMockDownloader(ctrl)
+	downloaderMock.EXPECT().DownloadRSSFeedConditional("file://dummy", gomock.Any()).
+		DoAndReturn(func(string, downloader.Validators) (*downloader.Download, error) {
+			close(started)
+			<-block
+			return &downloader.Download{Data: rssContent}, nil
+		}).Times(1)
+	downloaderMock.EXPECT().DownloadRSSFeedConditional("https://example.com/rss", gomock.Any()).
+		DoAndReturn(func(string, downloader.Validators) (*downloader.Download, error) {
+			assert.True(t, unlocked.Load(), "Proxy update should wait for the running update")
+			return &downloader.Download{Data: rssContent}, nil
+		}).Times(1)
+
+	df, err := setupTestDeframer(t, openAIMock, src, downloaderMock)
+	assert.NoError(t, err)
+	d := df.(*deframer)
+
+	errc := make(chan error)
+	go func() {
+		errc <- df.UpdateFeed(src.Feeds[0])
+	}()
+	<-started
+
+	// the scheduler and the startup skip the running update
+	err = df.UpdateFeed(src.Feeds[0])
+	assert.ErrorIs(t, err, ErrUpdateRunning)
+	report, err := df.UpdateFeeds()
+	assert.NoError(t, err)
+	assert.True(t, report.Feeds[0].Skipped)
+
+	close(block)
+	assert.NoError(t, <-errc)
+
+	// proxy requests wait for the running update
+	assert.True(t, d.updates.tryLock("https://example.com/rss"))
+	go func() {
+		_, err := df.DeframeURL("https://example.com/rss", "dummy", FeedOptions{})
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	unlocked.Store(true)
+	d.updates.unlock("https://example.com/rss")
+	assert.NoError(t, <-errc)
+	assert.Empty(t, d.updates.locks)
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	assert.Equal(t, FormatRSS, NegotiateFormat("", ""))
+	assert.Equal(t, FormatAtom, NegotiateFormat("atom", "application/feed+json"))
+	assert.Equal(t, FormatJSON, NegotiateFormat("", "text/html, application/feed+json;q=0.9"))
+	assert.Equal(t, FormatAtom, NegotiateFormat("", "application/atom+xml"))
+	assert.Equal(t, FormatRSS, NegotiateFormat("unknown", "*/*"))
+	assert.Equal(t, "application/atom+xml;charset=UTF-8", FormatAtom.ContentType())
+}
+
+func TestDeframeFormats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	jsonString := `{ "title_corrected": "dummy title", "framing": 0.2, "reason": "My Reason" }`
+
+	analysis, errAnalysis := openai.ParseAnalysis(jsonString)
+
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(analysis, errAnalysis).Times(3)
+	source, err := source.ParseString(sourceContent)
+	d, err := setupTestDeframer(t, openAIMock, source, nil)
+	assert.NoError(t, err)
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(string(rssContent))
+	assert.NoError(t, err)
+
+	str, err := d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{Format: FormatAtom})
+	assert.NoError(t, err)
+	assert.Contains(t, str, `<feed xmlns="http://www.w3.org/2005/Atom" xmlns:deframer="`+Namespace+`"`)
+	assert.Contains(t, str, `<deframer:content type="framing" score="0.2">My Reason</deframer:content>`)
+
+	str, err = d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{Format: FormatJSON})
+	assert.NoError(t, err)
+	assert.Contains(t, str, `"version": "https://jsonfeed.org/version/1.1"`)
+	assert.Contains(t, str, `"_deframer": {`)
+	assert.Contains(t, str, `"reason": "My Reason"`)
+
+	str, err = d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{Format: FormatJSON, Embedded: true})
+	assert.NoError(t, err)
+	assert.NotContains(t, str, "_deframer")
+}
+
+func TestDeframeMetadata(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	feedContent := `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd">
+  <channel>
+    <title>Podcast</title>
+    <link>https://example.com/</link>
+    <description>Description</description>
+    <language>de</language>
+    <category>News</category>
+    <itunes:author>Author</itunes:author>
+    <item>
+      <title>Episode 1</title>
+      <link>https://example.com/episode1</link>
+      <guid>episode1</guid>
+      <description>Desc Episode 1</description>
+      <category>Politics</category>
+      <category>World</category>
+      <enclosure url="https://example.com/episode1.mp3" length="1234" type="audio/mpeg"/>
+      <media:thumbnail url="https://example.com/episode1.jpg" width="120"/>
+    </item>
+  </channel>
+</rss>`
+
+	jsonString := `{ "title_corrected": "dummy title", "framing": 0.2, "reason": "My Reason" }`
+
+	analysis, errAnalysis := openai.ParseAnalysis(jsonString)
+
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(analysis, errAnalysis).Times(1)
+	source, err := source.ParseString(sourceContent)
+	assert.NoError(t, err)
+	d, err := setupTestDeframer(t, openAIMock, source, nil)
+	assert.NoError(t, err)
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(feedContent)
+	assert.NoError(t, err)
+
+	str, err := d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{Embedded: true})
+	assert.NoError(t, err)
+	assert.Contains(t, str, `xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"`)
+	assert.Contains(t, str, `xmlns:media="http://search.yahoo.com/mrss/"`)
+	assert.Contains(t, str, `<language>de</language>`)
+	assert.Contains(t, str, `<category>News</category>`)
+	assert.Contains(t, str, `<itunes:author>Author</itunes:author>`)
+	assert.Contains(t, str, `<category>Politics</category>`)
+	assert.Contains(t, str, `<category>World</category>`)
+	assert.Contains(t, str, `<enclosure url="https://example.com/episode1.mp3" length="1234" type="audio/mpeg"></enclosure>`)
+	assert.Contains(t, str, `<media:thumbnail url="https://example.com/episode1.jpg" width="120"></media:thumbnail>`)
+	assert.NotContains(t, str, "deframer")
+
+	str, err = d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{Format: FormatAtom})
+	assert.NoError(t, err)
+	assert.Contains(t, str, `<category term="Politics"></category>`)
+	assert.Contains(t, str, `rel="enclosure"`)
+
+	str, err = d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{Format: FormatJSON})
+	assert.NoError(t, err)
+	assert.Contains(t, str, `"language": "de"`)
+	assert.Contains(t, str, `"image": "https://example.com/episode1.jpg"`)
+	assert.Contains(t, str, `"url": "https://example.com/episode1.mp3"`)
+	assert.Contains(t, str, `"size": 1234`)
+}
+
+func TestDeframeFeedFilter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	jsonString := `{ "title_corrected": "dummy title", "clickbait": 0.8, "framing": 0.2, "reason_framing": "My Reason" }`
+
+	analysis, errAnalysis := openai.ParseAnalysis(jsonString)
+
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(analysis, errAnalysis).Times(3)
+	source, err := source.ParseString(sourceContent)
+	d, err := setupTestDeframer(t, openAIMock, source, nil)
+	assert.NoError(t, err)
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(string(rssContent))
+	assert.NoError(t, err)
+
+	maxScore := 0.5
+
+	// the highest score is clickbait
+	str, err := d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{MaxScore: &maxScore, Embedded: true})
+	assert.NoError(t, err)
+	assert.NotContains(t, str, "<item>")
+
+	// only framing is below the threshold
+	str, err = d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{MaxScore: &maxScore, ScoreType: "framing", Embedded: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(str, "<item>"))
+
+	str, err = d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{MaxScore: &maxScore, ScoreType: "clickbait", Placeholder: true, Embedded: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(str, "<item>"))
+	assert.Contains(t, str, "<title>[Deframed] 3 items hidden</title>")
+	assert.Contains(t, str, "3 items hidden with a clickbait score above 0.5.")
+	assert.Contains(t, str, "deframer-hidden-")
+
+	// no placeholder without hidden items
+	maxScore = 1
+	str, err = d.DeframeFeed(parsedData, source.Feeds[0], FeedOptions{MaxScore: &maxScore, Placeholder: true, Embedded: true})
+	assert.NoError(t, err)
+	assert.NotContains(t, str, "hidden")
+}
+
+func TestRenderFeed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	jsonString := `{ "title_corrected": "dummy title", "framing": 0.2, "reason": "My Reason" }`
+
+	analysis, errAnalysis := openai.ParseAnalysis(jsonString)
+
+	// the items are analyzed once, rendering reads them from the database
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(analysis, errAnalysis).Times(3)
+
+	src, err := source.ParseString(sourceContent)
+	assert.NoError(t, err)
+	downloaderMock := mock_downloader.NewMockDownloader(ctrl)
+	downloaderMock.EXPECT().DownloadRSSFeedConditional(gomock.Any(), gomock.Any()).
+		Return(&downloader.Download{Data: rssContent}, nil).Times(1)
+
+	df, err := setupTestDeframer(t, openAIMock, src, downloaderMock)
+	assert.NoError(t, err)
+
+	err = df.UpdateFeed(src.Feeds[0])
+	assert.NoError(t, err)
+
+	dbFeeds, err := df.FindAllFeeds()
+	assert.NoError(t, err)
+	assert.Len(t, dbFeeds, 1)
+
+	feedItems, err := df.(*deframer).db.FindFeedItems(dbFeeds[0].ID)
+	assert.NoError(t, err)
+	assert.Len(t, feedItems, 3)
+	assert.NotNil(t, feedItems[0].Item)
+
+	str, err := df.RenderFeed(&dbFeeds[0], FeedOptions{Embedded: true})
+	assert.NoError(t, err)
+	assert.Contains(t, str, "<title>[Deframed] Title</title>")
+	assert.Contains(t, str, "<title>Score: 0.2 - dummy title</title>")
+	assert.Less(t, strings.Index(str, "guid1"), strings.Index(str, "guid2"), "Items should keep their order")
+	assert.Less(t, strings.Index(str, "guid2"), strings.Index(str, "guid3"), "Items should keep their order")
+
+	str, err = df.RenderFeed(&dbFeeds[0], FeedOptions{Format: FormatJSON})
+	assert.NoError(t, err)
+	assert.Contains(t, str, `"_deframer": {`)
+
+	// rendered once per feed version and options
+	key := renderKey(&dbFeeds[0], FeedOptions{Format: FormatJSON})
+	cached, ok := df.(*deframer).renders.get(key)
+	assert.True(t, ok)
+	assert.Equal(t, str, cached)
+}
+
+func TestRenderCache(t *testing.T) {
+	c := newRenderCache(2)
+
+	c.put("a", "1")
+	c.put("b", "2")
+	_, ok := c.get("a")
+	assert.True(t, ok)
+
+	// b is the least recently used
+	c.put("c", "3")
+	_, ok = c.get("b")
+	assert.False(t, ok)
+
+	value, ok := c.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "1", value)
+}
+
+func TestPrune(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	d, err := setupTestDeframer(t, mock_openai.NewMockOpenAI(ctrl), nil, mock_downloader.NewMockDownloader(ctrl))
+	assert.NoError(t, err)
+
+	impl := d.(*deframer)
+	impl.retention = database.RetentionPolicy{Grace: time.Hour}
+	impl.vacuum = true
+
+	lastSeen := time.Now().Add(-2 * time.Hour)
+	err = impl.db.CreateItem(&database.Item{Hash: "orphaned", LastSeenAt: &lastSeen})
+	assert.NoError(t, err)
+
+	before := prunedItems.Value()
+	res, err := d.Prune()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), res.Items)
+	assert.Equal(t, before+1, prunedItems.Value(), "Pruned items should be counted")
+	assert.NotEmpty(t, lastPrune.Value())
+}
+
+func TestReload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	src, err := source.ParseString(sourceContent)
+	assert.NoError(t, err)
+	d, err := setupTestDeframer(t, mock_openai.NewMockOpenAI(ctrl), src, nil)
+	assert.NoError(t, err)
+
+	sourceFile := filepath.Join(t.TempDir(), "source.json")
+	d.(*deframer).sourceFile = sourceFile
+
+	err = os.WriteFile(sourceFile, []byte(`{
+		"feeds": [ { "rss_url": "https://example.com/rss", "language": "en" } ],
+		"prompts": [ { "user": "$TITLE", "language": "en" } ]
+	}`), 0o600)
+	assert.NoError(t, err)
+
+	assert.NoError(t, d.Reload())
+	assert.Len(t, d.Feeds(), 1)
+	assert.Equal(t, "https://example.com/rss", d.Feeds()[0].RSS_URL)
+	_, ok := d.(*deframer).findPrompt("en")
+	assert.True(t, ok, "New prompt should be used")
+
+	// invalid files keep the current feeds and prompts
+	err = os.WriteFile(sourceFile, []byte(`{ "feeds": [ { "rss_url": "" } ] }`), 0o600)
+	assert.NoError(t, err)
+
+	err = d.Reload()
+	assert.ErrorContains(t, err, "missing rss_url")
+	assert.Len(t, d.Feeds(), 1)
+	assert.Equal(t, "https://example.com/rss", d.Feeds()[0].RSS_URL)
+}
+
+func TestAIFor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	src, err := source.ParseString(`{
+		"feeds": [ { "rss_url": "https://example.com/rss", "language": "en", "backends": [ "local" ] } ],
+		"prompts": [ { "user": "$TITLE", "language": "en", "backends": [ "local", "default" ] } ],
+		"backends": [ { "name": "local", "url": "http://localhost:1234/v1", "model": "phi-4" } ]
+	}`)
+	assert.NoError(t, err)
+
+	df, err := setupTestDeframer(t, mock_openai.NewMockOpenAI(ctrl), nil, nil)
+	assert.NoError(t, err)
+	d := df.(*deframer)
+
+	settings, err := d.loadSettings(src)
+	assert.NoError(t, err)
+	d.settings.Store(settings)
+
+	prompt, _ := d.findPrompt("en")
+
+	ai, ok := d.aiFor(src.Feeds[0], prompt).(openai.Backend)
+	assert.True(t, ok, "The feed should use a single backend")
+	assert.Equal(t, "local", ai.Name())
+
+	_, ok = d.aiFor(source.Feed{Language: "en"}, prompt).(openai.Backend)
+	assert.False(t, ok, "The prompt backends should be routed")
+
+	ai, ok = d.aiFor(source.Feed{Language: "fr"}, source.Prompt{}).(openai.Backend)
+	assert.True(t, ok)
+	assert.Equal(t, source.DefaultBackend, ai.Name())
+
+	// without AI_MODEL the default backend can't be assigned
+	d.ai = nil
+	_, err = d.loadSettings(src)
+	assert.ErrorContains(t, err, `backend "default" is not configured`)
+
+	_, err = d.loadSettings(&source.Source{})
+	assert.ErrorContains(t, err, "no AI backend")
+}
+
+func TestWeightedConsensus(t *testing.T) {
+	low, high := 0.2, 0.8
+	consensus := weightedConsensus([]rating{
+		{weight: 1, analysis: &openai.Analysis{Framing: &low, Clickbait: &low}},
+		{weight: 0.5, analysis: &openai.Analysis{Framing: &high}},
+	})
+	assert.InDelta(t, 0.4, *consensus.Framing, 1e-9)
+	assert.Equal(t, 0.2, *consensus.Clickbait, "Missing scores should not count")
+	assert.Nil(t, consensus.HyperStimulus)
+
+	dev, ok := deviation(&openai.Analysis{Framing: &high, Clickbait: &high}, consensus)
+	assert.True(t, ok)
+	assert.InDelta(t, 0.5, dev, 1e-9)
+
+	_, ok = deviation(&openai.Analysis{HyperStimulus: &high}, consensus)
+	assert.False(t, ok)
+
+	assert.Equal(t, 1.0, reputationWeight(0))
+	assert.Equal(t, minWeight, reputationWeight(0.6))
+}
+
+func TestEnsemble(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	src, err := source.ParseString(sourceContent)
+	assert.NoError(t, err)
+	df, err := setupTestDeframer(t, mock_openai.NewMockOpenAI(ctrl), src, nil)
+	assert.NoError(t, err)
+	d := df.(*deframer)
+
+	rater := func(title string, framing float64, err error) openai.Backend {
+		ai := mock_openai.NewMockOpenAI(ctrl)
+		ai.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(&openai.Analysis{TitleCorrected: &title, Framing: &framing}, err).AnyTimes()
+		return openai.NewBackend(title, ai, 0)
+	}
+
+	src.Ensemble = &source.Ensemble{Backends: []string{"a", "b", "c", "d"}}
+	settings := newSettings(src)
+	settings.ensemble = []openai.Backend{
+		rater("a", 0.2, nil),
+		rater("b", 0.3, nil),
+		rater("c", 0.9, nil),
+		rater("d", 0, errors.New("AI failed")),
+	}
+	d.settings.Store(settings)
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(string(rssContent))
+	assert.NoError(t, err)
+
+	item, err := d.DeframeItem(parsedData.Items[0], src.Feeds[0])
+	assert.NoError(t, err)
+	assert.InDelta(t, (0.2+0.3+0.9)/3, *item.Framing, 1e-9)
+	assert.Equal(t, "b", *item.TitleAI, "The closest rating should provide the texts")
+
+	ratings, err := d.db.FindRatingsByItemID(item.ID)
+	assert.NoError(t, err)
+	assert.Len(t, ratings, 3, "Failed backends should not be stored")
+
+	reputations, err := d.db.FindReputations()
+	assert.NoError(t, err)
+	assert.Len(t, reputations, 3)
+	weights := map[string]float64{}
+	for _, rep := range reputations {
+		weights[rep.Backend] = rep.Weight
+	}
+	assert.Greater(t, weights["b"], weights["a"])
+	assert.Greater(t, weights["a"], weights["c"])
+
+	// the next consensus is weighted by the reputation
+	item, err = d.DeframeItem(parsedData.Items[1], src.Feeds[0])
+	assert.NoError(t, err)
+	assert.Less(t, *item.Framing, (0.2+0.3+0.9)/3)
+
+	// below the quorum the item is not analyzed
+	src.Ensemble.Quorum = 4
+	_, err = d.DeframeItem(parsedData.Items[2], src.Feeds[0])
+	assert.ErrorContains(t, err, "3 of 4 backends rated the item, the quorum is 4")
+}
+
+func TestTokenBudget(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the budget is used up, the AI is not asked
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	src, err := source.ParseString(sourceContent)
+	assert.NoError(t, err)
+	df, err := setupTestDeframer(t, openAIMock, src, nil)
+	assert.NoError(t, err)
+	d := df.(*deframer)
+	d.dailyTokens = 100
+
+	err = d.db.CreateAICall(&database.AICall{FeedUrl: src.Feeds[0].RSS_URL, Model: "model", PromptTokens: 80, CompletionTokens: 20})
+	assert.NoError(t, err)
+
+	parser := gofeed.NewParser()
+	parsedData, err := parser.ParseString(string(rssContent))
+	assert.NoError(t, err)
+
+	_, err = d.DeframeItem(parsedData.Items[0], src.Feeds[0])
+	assert.ErrorIs(t, err, ErrBudgetExceeded)
+
+	// the items are passed through even if errors are not tolerated
+	items, skipped, failed, err := d.deframeItems(parsedData.Items, src.Feeds[0])
+	assert.NoError(t, err)
+	assert.Zero(t, failed, "Skipped items are not failed")
+	assert.Equal(t, []bool{true, true, true}, skipped)
+	assert.Nil(t, items[0])
+
+	// the feed is updated, the skipped items are reported
+	downloaderMock := mock_downloader.NewMockDownloader(ctrl)
+	downloaderMock.EXPECT().DownloadRSSFeedConditional("file://dummy", gomock.Any()).
+		DoAndReturn(func(_ string, validators downloader.Validators) (*downloader.Download, error) {
+			if validators.ETag == "v1" {
+				return &downloader.Download{NotModified: true, Validators: validators}, nil
+			}
+			return &downloader.Download{Data: rssContent, Validators: downloader.Validators{ETag: "v1"}}, nil
+		}).Times(3)
+	d.downloader = downloaderMock
+	feedReport := d.updateFeed(src.Feeds[0])
+	assert.NoError(t, feedReport.Err)
+	assert.Zero(t, feedReport.FailedItems)
+	assert.Equal(t, len(parsedData.Items), feedReport.SkippedItems)
+	assert.Equal(t, database.FeedStatusOK, feedReport.feed.Status)
+
+	// the skipped items are flagged, not failed
+	str, err := d.RenderFeed(feedReport.feed, FeedOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, str, `<deframer:meta status="skipped"></deframer:meta>`)
+	assert.NotContains(t, str, `status="failed"`)
+
+	usage, err := d.FindUsage(time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, usage, 1)
+	assert.Equal(t, int64(80), usage[0].PromptTokens)
+
+	// the next day - the feed is downloaded again, although it is not modified
+	d.dailyTokens = 0
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&openai.Analysis{}, nil).Times(3)
+	feedReport = d.updateFeed(src.Feeds[0])
+	assert.NoError(t, feedReport.Err)
+	assert.False(t, feedReport.NotModified, "Skipped items should be analyzed")
+	assert.Zero(t, feedReport.SkippedItems)
+	str, err = d.RenderFeed(feedReport.feed, FeedOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, str, `status="skipped"`)
+
+	// all items are analyzed, the validators are sent
+	feedReport = d.updateFeed(src.Feeds[0])
+	assert.NoError(t, feedReport.Err)
+	assert.True(t, feedReport.NotModified)
+}
+
+func TestPromptTemplate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	src, err := source.ParseString(`{
+		"feeds": [ { "rss_url": "file://dummy", "language": "en" } ],
+		"prompts": [ {
+			"user": "{{.FeedTitle}} | {{.Title}} | {{.Link}} | {{.Published}} | {{join .Categories \", \"}} | {{.Author}}",
+			"system": "Answer in {{.Language}}",
+			"language": "en"
+		} ]
+	}`)
+	assert.NoError(t, err)
+
+	var user, system string
+	openAIMock := mock_openai.NewMockOpenAI(ctrl)
+	openAIMock.EXPECT().Analyze(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, u string, s string) (*openai.Analysis, error) {
+			user, system = u, s
+			return &openai.Analysis{}, nil
+		}).Times(1)
+
+	d, err := setupTestDeframer(t, openAIMock, src, nil)
+	assert.NoError(t, err)
+
+	parsedData := &gofeed.Feed{
+		Title: "Example News",
+		Items: []*gofeed.Item{{
+			Title:      `Minister says "no"`,
+			Link:       "https://www.example.com/item/link1",
+			Published:  "Fri, 01 Aug 2025 12:41:20 +0200",
+			GUID:       "guid1",
+			Categories: []string{"politics", "world"},
+			Authors:    []*gofeed.Person{{Name: "Jane Doe"}},
+		}},
+	}
+
+	_, err = d.DeframeFeed(parsedData, src.Feeds[0], FeedOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, `Example News | Minister says \"no\" | https://www.example.com/item/link1 | Fri, 01 Aug 2025 12:41:20 +0200 | politics, world | Jane Doe`, user)
+	assert.Equal(t, "Answer in en", system)
+}
@@ -0,0 +1,178 @@
+package deframer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/egandro/news-deframer/pkg/database"
+	"github.com/egandro/news-deframer/pkg/openai"
+	"goa.design/clue/log"
+)
+
+const (
+	reputationRate = 0.1 // influence of a new deviation on the running deviation of a backend
+	minWeight      = 0.1 // the least trusted backends keep some influence
+)
+
+// rating is the analysis of one backend of the ensemble
+type rating struct {
+	backend  string
+	weight   float64
+	analysis *openai.Analysis
+}
+
+// rate analyzes the item with all backends of the ensemble. The scores are the weighted average
+// of the ratings, the texts are taken from the rating closest to the consensus. The distance
+// from the consensus updates the reputation of the backends.
+func (d *deframer) rate(ctx context.Context, ensemble []openai.Backend, quorum int, user string, system string) (*openai.Analysis, []database.Rating, error) {
+	analyses := make([]*openai.Analysis, len(ensemble))
+	errs := make([]error, len(ensemble))
+
+	var wg sync.WaitGroup
+	for i, b := range ensemble {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			analyses[i], errs[i] = b.Analyze(ctx, user, system)
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	reputations, err := d.db.FindReputations()
+	if err != nil {
+		return nil, nil, err
+	}
+	weights := map[string]float64{}
+	for _, rep := range reputations {
+		weights[rep.Backend] = rep.Weight
+	}
+
+	ratings := []rating{}
+	for i, b := range ensemble {
+		if errs[i] != nil {
+			log.Printf(d.ctx, "backend %q can't rate the item: %v", b.Name(), errs[i])
+			continue
+		}
+
+		weight, ok := weights[b.Name()]
+		if !ok {
+			// unknown backends are trusted
+			weight = 1
+		}
+		ratings = append(ratings, rating{backend: b.Name(), weight: weight, analysis: analyses[i]})
+	}
+
+	if len(ratings) < quorum {
+		return nil, nil, fmt.Errorf("%v of %v backends rated the item, the quorum is %v: %w",
+			len(ratings), len(ensemble), quorum, errors.Join(errs...))
+	}
+
+	consensus := weightedConsensus(ratings)
+
+	res := make([]database.Rating, len(ratings))
+	closest := 0
+	for i, r := range ratings {
+		res[i] = database.Rating{
+			Backend:          r.backend,
+			Weight:           r.weight,
+			Clickbait:        r.analysis.Clickbait,
+			Framing:          r.analysis.Framing,
+			PersuasiveIntent: r.analysis.PersuasiveIntent,
+			HyperStimulus:    r.analysis.HyperStimulus,
+		}
+
+		if len(ratings) < 2 {
+			// a single rating is the consensus
+			continue
+		}
+
+		deviation, ok := deviation(r.analysis, consensus)
+		if !ok {
+			continue
+		}
+		res[i].Deviation = &deviation
+		if res[closest].Deviation == nil || deviation < *res[closest].Deviation {
+			closest = i
+		}
+
+		_, err := d.db.UpdateReputation(r.backend, func(rep *database.Reputation) {
+			if rep.Ratings == 0 {
+				rep.Deviation = deviation
+			} else {
+				rep.Deviation += reputationRate * (deviation - rep.Deviation)
+			}
+			rep.Ratings++
+			rep.Weight = reputationWeight(rep.Deviation)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	analysis := *ratings[closest].analysis
+	analysis.Clickbait = consensus.Clickbait
+	analysis.Framing = consensus.Framing
+	analysis.PersuasiveIntent = consensus.PersuasiveIntent
+	analysis.HyperStimulus = consensus.HyperStimulus
+
+	return &analysis, res, nil
+}
+
+// scoreFields returns the scores of an analysis
+func scoreFields(a *openai.Analysis) []**float64 {
+	return []**float64{&a.Clickbait, &a.Framing, &a.PersuasiveIntent, &a.HyperStimulus}
+}
+
+// weightedConsensus returns the weighted average of each score, nil if no rating has the score
+func weightedConsensus(ratings []rating) *openai.Analysis {
+	res := &openai.Analysis{}
+
+	for k, target := range scoreFields(res) {
+		sum, total := 0.0, 0.0
+		for _, r := range ratings {
+			score := *scoreFields(r.analysis)[k]
+			if score == nil {
+				continue
+			}
+			sum += r.weight * *score
+			total += r.weight
+		}
+
+		if total > 0 {
+			avg := sum / total
+			*target = &avg
+		}
+	}
+
+	return res
+}
+
+// deviation returns the mean distance of the scores from the consensus, false if no score is comparable
+func deviation(a *openai.Analysis, consensus *openai.Analysis) (float64, bool) {
+	sum, n := 0.0, 0
+	for k, score := range scoreFields(a) {
+		target := *scoreFields(consensus)[k]
+		if *score == nil || target == nil {
+			continue
+		}
+		sum += math.Abs(**score - *target)
+		n++
+	}
+
+	if n == 0 {
+		return 0, false
+	}
+	return sum / float64(n), true
+}
+
+// reputationWeight maps the running deviation to a weight, a deviation of 0.45 or more has the least weight
+func reputationWeight(deviation float64) float64 {
+	return max(minWeight, 1-2*deviation)
+}
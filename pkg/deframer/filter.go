@@ -0,0 +1,61 @@
+package deframer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/egandro/news-deframer/pkg/database"
+	"github.com/gorilla/feeds"
+	"github.com/mmcdole/gofeed"
+)
+
+// hides returns true if the item is filtered by its score
+func (o FeedOptions) hides(item *database.Item) bool {
+	if o.MaxScore == nil {
+		return false
+	}
+
+	score := item.MaxScore()
+	if o.ScoreType != "" {
+		score = item.Score(o.ScoreType)
+	}
+
+	return score != nil && *score > *o.MaxScore
+}
+
+// placeholderItem summarizes the hidden items. The id changes with the hidden items,
+// so readers show it again when more items are hidden.
+func placeholderItem(parsedData *gofeed.Feed, hidden []*gofeed.Item, opts FeedOptions) *feeds.Item {
+	guids := []string{}
+	created := time.Time{}
+	for _, item := range hidden {
+		guids = append(guids, item.GUID)
+		if item.PublishedParsed != nil && item.PublishedParsed.After(created) {
+			created = *item.PublishedParsed
+		}
+	}
+
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	score := "the highest score"
+	if opts.ScoreType != "" {
+		score = "a " + strings.ReplaceAll(opts.ScoreType, "_", " ") + " score"
+	}
+
+	title := fmt.Sprintf("%v items hidden", len(hidden))
+	if len(hidden) == 1 {
+		title = "1 item hidden"
+	}
+
+	return &feeds.Item{
+		Title:       "[Deframed] " + title,
+		Link:        &feeds.Link{Href: parsedData.Link},
+		Description: fmt.Sprintf("%v with %v above %v.", title, score, *opts.MaxScore),
+		Id:          fmt.Sprintf("deframer-hidden-%x", sha256.Sum256([]byte(strings.Join(guids, "\n")))),
+		Created:     created,
+	}
+}
@@ -0,0 +1,86 @@
+package deframer
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/gorilla/feeds"
+)
+
+// Format of a rendered feed
+type Format string
+
+const (
+	FormatRSS  Format = "rss"
+	FormatAtom Format = "atom"
+	FormatJSON Format = "json"
+)
+
+// ContentType returns the http content type of the format
+func (f Format) ContentType() string {
+	switch f {
+	case FormatAtom:
+		return "application/atom+xml;charset=UTF-8"
+	case FormatJSON:
+		return "application/feed+json;charset=UTF-8"
+	default:
+		return "application/rss+xml;charset=UTF-8"
+	}
+}
+
+// NegotiateFormat selects the format by the format parameter, then by the accept header.
+// RSS is the default.
+func NegotiateFormat(format string, accept string) Format {
+	switch Format(format) {
+	case FormatRSS, FormatAtom, FormatJSON:
+		return Format(format)
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		switch mediaType {
+		case "application/rss+xml":
+			return FormatRSS
+		case "application/atom+xml":
+			return FormatAtom
+		case "application/feed+json", "application/json":
+			return FormatJSON
+		}
+	}
+
+	return FormatRSS
+}
+
+// render serializes the feed with the upstream metadata.
+// The scores are only added if the feed is not embedded.
+func render(feed *feeds.Feed, extra *feedExtra, opts FeedOptions) (string, error) {
+	// without scores the feed is a drop-in replacement
+	annotated := !opts.Embedded
+
+	switch opts.Format {
+	case FormatAtom:
+		return feeds.ToXML(&deframerAtom{
+			Atom:      &feeds.Atom{Feed: feed},
+			extra:     extra,
+			annotated: annotated,
+		})
+
+	case FormatJSON:
+		return (&deframerJSON{
+			JSON:      &feeds.JSON{Feed: feed},
+			extra:     extra,
+			annotated: annotated,
+		}).ToJSON()
+
+	default:
+		return feeds.ToXML(&deframerRss{
+			Rss:       &feeds.Rss{Feed: feed},
+			extra:     extra,
+			annotated: annotated,
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package deframer
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/gorilla/feeds"
+	"github.com/mmcdole/gofeed"
+)
+
+// deframerJSON is a json feed with the upstream metadata and a "_deframer" extension per item
+type deframerJSON struct {
+	*feeds.JSON
+	extra     *feedExtra
+	annotated bool // add the "_deframer" extensions
+}
+
+type deframerJSONFeed struct {
+	*feeds.JSONFeed
+	Items []*deframerJSONItem `json:"items,omitempty"`
+}
+
+type deframerJSONItem struct {
+	*feeds.JSONItem
+	Group *deframerGroup `json:"_deframer,omitempty"`
+}
+
+// ToJSON encodes the feed
+func (f *deframerJSON) ToJSON() (string, error) {
+	jsonFeed := f.JSONFeed()
+
+	jsonFeed.Language = f.extra.language
+	if f.Image != nil {
+		jsonFeed.Icon = f.Image.Url
+	}
+
+	res := &deframerJSONFeed{
+		JSONFeed: jsonFeed,
+	}
+
+	for i, item := range jsonFeed.Items {
+		extra := f.extra.item(i)
+
+		item.Tags = extra.categories
+		if extra.image != "" {
+			item.Image = extra.image
+		}
+		for _, enclosure := range extra.enclosures {
+			item.Attachments = append(item.Attachments, newJSONAttachment(enclosure))
+		}
+
+		current := &deframerJSONItem{JSONItem: item}
+		if f.annotated {
+			current.Group = extra.group
+		}
+		res.Items = append(res.Items, current)
+	}
+
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func newJSONAttachment(enclosure *gofeed.Enclosure) feeds.JSONAttachment {
+	res := feeds.JSONAttachment{
+		Url:      enclosure.URL,
+		MIMEType: enclosure.Type,
+	}
+
+	if size, err := strconv.ParseInt(enclosure.Length, 10, 32); err == nil {
+		res.Size = int32(size)
+	}
+
+	return res
+}
@@ -0,0 +1,86 @@
+package deframer
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrUpdateRunning is returned when an update of the same feed is still running
+var ErrUpdateRunning = errors.New("update of the feed is still running")
+
+// feedLocks makes sure the updates of a feed never overlap
+type feedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*feedLock // by feed url
+}
+
+type feedLock struct {
+	slot chan struct{}
+	refs int // holders and waiters, the lock is removed at 0
+}
+
+func newFeedLocks() *feedLocks {
+	return &feedLocks{
+		locks: make(map[string]*feedLock),
+	}
+}
+
+// tryLock locks the feed, false if it is locked already
+func (l *feedLocks) tryLock(feedUrl string) bool {
+	lock := l.ref(feedUrl)
+
+	select {
+	case lock.slot <- struct{}{}:
+		return true
+	default:
+		l.unref(feedUrl)
+		return false
+	}
+}
+
+// lock waits until the feed is unlocked or the context is cancelled
+func (l *feedLocks) lock(ctx context.Context, feedUrl string) error {
+	lock := l.ref(feedUrl)
+
+	select {
+	case lock.slot <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		l.unref(feedUrl)
+		return ctx.Err()
+	}
+}
+
+func (l *feedLocks) unlock(feedUrl string) {
+	l.mu.Lock()
+	lock := l.locks[feedUrl]
+	l.mu.Unlock()
+
+	<-lock.slot
+	l.unref(feedUrl)
+}
+
+func (l *feedLocks) ref(feedUrl string) *feedLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, ok := l.locks[feedUrl]
+	if !ok {
+		lock = &feedLock{slot: make(chan struct{}, 1)}
+		l.locks[feedUrl] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+func (l *feedLocks) unref(feedUrl string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock := l.locks[feedUrl]
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, feedUrl)
+	}
+}
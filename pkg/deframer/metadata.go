@@ -0,0 +1,188 @@
+package deframer
+
+import (
+	"encoding/xml"
+	"slices"
+
+	"github.com/gorilla/feeds"
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+)
+
+// namespaces of the extensions that are passed through, by their canonical gofeed prefix.
+// Extensions with other prefixes are dropped, their namespace is unknown.
+var namespaces = map[string]string{
+	"dc":         "http://purl.org/dc/elements/1.1/",
+	"dcterms":    "http://purl.org/dc/terms/",
+	"georss":     "http://www.georss.org/georss",
+	"itunes":     "http://www.itunes.com/dtds/podcast-1.0.dtd",
+	"media":      "http://search.yahoo.com/mrss/",
+	"psc":        "http://podlove.org/simple-chapters",
+	"slash":      "http://purl.org/rss/1.0/modules/slash/",
+	"sy":         "http://purl.org/rss/1.0/modules/syndication/",
+	"thr":        "http://purl.org/rss/1.0/modules/threading/",
+	"wfw":        "http://wellformedweb.org/commentAPI/",
+	"podcast":    "https://podcastindex.org/namespace/1.0",
+	"googleplay": "http://www.google.com/schemas/play-podcasts/1.0",
+}
+
+// feedExtra is the upstream metadata that gorilla/feeds doesn't support
+type feedExtra struct {
+	language   string
+	categories []string
+	generator  string
+	extensions []extensionElement
+	items      []*itemExtra // same order as the feed items
+}
+
+// itemExtra is the upstream metadata of an item and its scores
+type itemExtra struct {
+	group      *deframerGroup // nil for items without scores
+	categories []string
+	enclosures []*gofeed.Enclosure
+	image      string
+	extensions []extensionElement
+}
+
+// extensionElement is an upstream extension element, e.g. media:thumbnail
+type extensionElement struct {
+	prefix string
+	ext.Extension
+}
+
+func newFeedExtra(parsedData *gofeed.Feed) *feedExtra {
+	return &feedExtra{
+		language:   parsedData.Language,
+		categories: parsedData.Categories,
+		generator:  parsedData.Generator,
+		extensions: newExtensionElements(parsedData.Extensions),
+	}
+}
+
+func newItemExtra(item *gofeed.Item, group *deframerGroup) *itemExtra {
+	res := &itemExtra{
+		group:      group,
+		categories: item.Categories,
+		enclosures: item.Enclosures,
+		extensions: newExtensionElements(item.Extensions),
+	}
+
+	if item.Image != nil {
+		res.image = item.Image.URL
+	} else if thumbnails := item.Extensions["media"]["thumbnail"]; len(thumbnails) > 0 {
+		res.image = thumbnails[0].Attrs["url"]
+	}
+
+	return res
+}
+
+// newEnclosure converts an upstream enclosure, rss requires a type and a length
+func newEnclosure(enclosure *gofeed.Enclosure) *feeds.Enclosure {
+	res := &feeds.Enclosure{
+		Url:    enclosure.URL,
+		Type:   enclosure.Type,
+		Length: enclosure.Length,
+	}
+
+	if res.Type == "" {
+		res.Type = "application/octet-stream"
+	}
+
+	if res.Length == "" {
+		res.Length = "0"
+	}
+
+	return res
+}
+
+// item returns the metadata of the item with the given index
+func (f *feedExtra) item(i int) *itemExtra {
+	if f == nil || i >= len(f.items) || f.items[i] == nil {
+		return &itemExtra{}
+	}
+	return f.items[i]
+}
+
+// namespaceAttrs declares the namespaces of all extensions of the feed
+func (f *feedExtra) namespaceAttrs() []xml.Attr {
+	used := map[string]bool{}
+	for _, e := range f.extensions {
+		used[e.prefix] = true
+	}
+	for _, item := range f.items {
+		if item == nil {
+			continue
+		}
+		for _, e := range item.extensions {
+			used[e.prefix] = true
+		}
+	}
+
+	res := []xml.Attr{}
+	for _, prefix := range sortedKeys(used) {
+		res = append(res, xml.Attr{
+			Name:  xml.Name{Local: "xmlns:" + prefix},
+			Value: namespaces[prefix],
+		})
+	}
+	return res
+}
+
+// newExtensionElements returns the extensions with a known namespace in a stable order
+func newExtensionElements(extensions ext.Extensions) []extensionElement {
+	res := []extensionElement{}
+	for _, prefix := range sortedKeys(extensions) {
+		if _, ok := namespaces[prefix]; !ok {
+			continue
+		}
+		for _, name := range sortedKeys(extensions[prefix]) {
+			for _, e := range extensions[prefix][name] {
+				res = append(res, extensionElement{prefix: prefix, Extension: e})
+			}
+		}
+	}
+	return res
+}
+
+// MarshalXML writes the element with its prefix, children use the prefix of the parent
+func (e extensionElement) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+	start := xml.StartElement{
+		Name: xml.Name{Local: e.prefix + ":" + e.Name},
+	}
+
+	for _, name := range sortedKeys(e.Attrs) {
+		start.Attr = append(start.Attr, xml.Attr{
+			Name:  xml.Name{Local: name},
+			Value: e.Attrs[name],
+		})
+	}
+
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+
+	if e.Value != "" {
+		if err := enc.EncodeToken(xml.CharData(e.Value)); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range sortedKeys(e.Children) {
+		for _, child := range e.Children[name] {
+			if err := enc.Encode(extensionElement{prefix: e.prefix, Extension: child}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	slices.Sort(res)
+	return res
+}
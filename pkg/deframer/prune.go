@@ -0,0 +1,45 @@
+package deframer
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/egandro/news-deframer/pkg/database"
+)
+
+// pruning metrics, served by expvar
+var (
+	prunedFeeds     = expvar.NewInt("deframer_pruned_feeds")
+	prunedItems     = expvar.NewInt("deframer_pruned_items")
+	prunedRevisions = expvar.NewInt("deframer_pruned_revisions")
+	prunedRatings   = expvar.NewInt("deframer_pruned_ratings")
+	lastPrune       = expvar.NewString("deframer_last_prune")
+)
+
+// Prune deletes the feeds and items outside of the retention policy
+func (d *deframer) Prune() (database.PruneResult, error) {
+	now := time.Now()
+
+	// the feeds of the source file are kept, even if they fail for a long time
+	policy := d.retention
+	for _, feed := range d.Feeds() {
+		policy.KeepFeeds = append(policy.KeepFeeds, feed.RSS_URL)
+	}
+
+	res, err := d.db.Prune(policy, now)
+	if err != nil {
+		return res, err
+	}
+
+	prunedFeeds.Add(res.Feeds)
+	prunedItems.Add(res.Items)
+	prunedRevisions.Add(res.Revisions)
+	prunedRatings.Add(res.Ratings)
+	lastPrune.Set(now.UTC().Format(time.RFC3339))
+
+	if d.vacuum && !res.Empty() {
+		return res, d.db.Vacuum()
+	}
+
+	return res, nil
+}
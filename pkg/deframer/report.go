@@ -0,0 +1,39 @@
+package deframer
+
+// FeedReport is the result of updating a single feed
+type FeedReport struct {
+	FeedUrl      string
+	Skipped      bool  // the cache was still valid
+	NotModified  bool  // the upstream feed didn't change
+	Items        int   // number of items in the feed
+	FailedItems  int   // items that can't be deframed, passed through
+	SkippedItems int   // items passed through without analysis, the daily token budget is used up
+	Err          error // the feed was not updated
+}
+
+// UpdateReport is the result of updating all feeds
+type UpdateReport struct {
+	Feeds []FeedReport
+}
+
+// Updated returns the number of updated feeds
+func (r *UpdateReport) Updated() int {
+	res := 0
+	for _, feed := range r.Feeds {
+		if !feed.Skipped && !feed.NotModified && feed.Err == nil {
+			res++
+		}
+	}
+	return res
+}
+
+// Failed returns the reports of the feeds that were not updated
+func (r *UpdateReport) Failed() []FeedReport {
+	res := []FeedReport{}
+	for _, feed := range r.Feeds {
+		if feed.Err != nil {
+			res = append(res, feed)
+		}
+	}
+	return res
+}
@@ -0,0 +1,142 @@
+package deframer
+
+import (
+	"encoding/xml"
+	"net/http"
+
+	"github.com/egandro/news-deframer/pkg/database"
+	"github.com/gorilla/feeds"
+)
+
+// Namespace is the xml namespace of the deframer rss extension
+const Namespace = "http://www.example.com/2026/deframer"
+
+// deframerRss is a rss 2.0 feed with the upstream metadata and a deframer:group per item
+type deframerRss struct {
+	*feeds.Rss
+	extra     *feedExtra
+	annotated bool // add the deframer:group elements
+}
+
+type deframerRssXml struct {
+	XMLName           xml.Name   `xml:"rss"`
+	Version           string     `xml:"version,attr"`
+	ContentNamespace  string     `xml:"xmlns:content,attr"`
+	DeframerNamespace string     `xml:"xmlns:deframer,attr,omitempty"`
+	Namespaces        []xml.Attr `xml:",any,attr"`
+	Channel           *deframerChannel
+}
+
+type deframerChannel struct {
+	*feeds.RssFeed
+	Categories []string           `xml:"category"`
+	Extensions []extensionElement `xml:",omitempty"`
+	Items      []*deframerItem    `xml:"item"`
+}
+
+type deframerItem struct {
+	*feeds.RssItem
+	Categories []string           `xml:"category"`
+	Extensions []extensionElement `xml:",omitempty"`
+	Group      *deframerGroup     `xml:"deframer:group,omitempty"`
+}
+
+type deframerGroup struct {
+	Meta     deframerMeta      `xml:"deframer:meta" json:"meta"`
+	Contents []deframerContent `xml:"deframer:content" json:"content,omitempty"`
+}
+
+type deframerMeta struct {
+	Updated string `xml:"updated,attr,omitempty" json:"updated,omitempty"`
+	Status  string `xml:"status,attr,omitempty" json:"status,omitempty"`
+}
+
+type deframerContent struct {
+	Type   string  `xml:"type,attr" json:"type"`
+	Score  float64 `xml:"score,attr" json:"score"`
+	Reason string  `xml:",chardata" json:"reason"`
+}
+
+// FeedXml returns the xml representation, this implements feeds.XmlFeed
+func (r *deframerRss) FeedXml() interface{} {
+	rssFeed := r.RssFeed()
+	rssFeed.Language = r.extra.language
+	rssFeed.Generator = r.extra.generator
+
+	channel := &deframerChannel{
+		RssFeed:    rssFeed,
+		Categories: r.extra.categories,
+		Extensions: r.extra.extensions,
+	}
+
+	for i, item := range rssFeed.Items {
+		extra := r.extra.item(i)
+		current := &deframerItem{
+			RssItem:    item,
+			Categories: extra.categories,
+			Extensions: extra.extensions,
+		}
+		if r.annotated {
+			current.Group = extra.group
+		}
+		channel.Items = append(channel.Items, current)
+	}
+
+	res := &deframerRssXml{
+		Version:          "2.0",
+		ContentNamespace: "http://purl.org/rss/1.0/modules/content/",
+		Namespaces:       r.extra.namespaceAttrs(),
+		Channel:          channel,
+	}
+	if r.annotated {
+		res.DeframerNamespace = Namespace
+	}
+
+	return res
+}
+
+// newDeframerGroup creates the scores of an item, nil if the item has no scores
+func newDeframerGroup(item *database.Item) *deframerGroup {
+	group := &deframerGroup{
+		Meta: deframerMeta{
+			Updated: item.UpdatedAt.UTC().Format(http.TimeFormat),
+		},
+	}
+
+	for _, score := range item.Scores() {
+		if score.Score == nil {
+			continue
+		}
+
+		reason := ""
+		if score.Reason != nil {
+			reason = *score.Reason
+		}
+
+		group.Contents = append(group.Contents, deframerContent{
+			Type:   score.Type,
+			Score:  *score.Score,
+			Reason: reason,
+		})
+	}
+
+	if len(group.Contents) == 0 {
+		return nil
+	}
+
+	return group
+}
+
+// passedDeframerGroup flags an item that was passed through without deframing,
+// the status is "failed" or "skipped" for items that are not analyzed yet
+func passedDeframerGroup(skipped bool) *deframerGroup {
+	status := "failed"
+	if skipped {
+		status = "skipped"
+	}
+	return &deframerGroup{
+		Meta: deframerMeta{
+			Status: status,
+		},
+	}
+}
@@ -0,0 +1,61 @@
+package deframer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/egandro/news-deframer/pkg/database"
+	"github.com/egandro/news-deframer/pkg/openai"
+	"github.com/egandro/news-deframer/pkg/source"
+	"goa.design/clue/log"
+)
+
+// ErrBudgetExceeded is returned for items that are not analyzed, the daily token budget is used up
+var ErrBudgetExceeded = errors.New("daily token budget exceeded")
+
+// checkBudget returns ErrBudgetExceeded if the tokens of today reached the budget.
+// Items analyzed at once can exceed the budget by their tokens.
+func (d *deframer) checkBudget() error {
+	if d.dailyTokens <= 0 {
+		return nil
+	}
+
+	tokens, err := d.db.TokensOnDay(database.Day(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	if tokens >= d.dailyTokens {
+		return ErrBudgetExceeded
+	}
+	return nil
+}
+
+// usageContext records the AI calls made with the context for the feed
+func (d *deframer) usageContext(feed source.Feed) context.Context {
+	return openai.WithUsage(d.ctx, func(usage openai.Usage) {
+		call := &database.AICall{
+			FeedUrl:          feed.RSS_URL,
+			Model:            usage.Model,
+			PromptTokens:     int64(usage.PromptTokens),
+			CompletionTokens: int64(usage.CompletionTokens),
+			LatencyMs:        usage.Latency.Milliseconds(),
+			Failed:           usage.Err != nil,
+		}
+
+		if price, ok := d.settings.Load().src.Prices[usage.Model]; ok {
+			cost := price.Cost(call.PromptTokens, call.CompletionTokens)
+			call.Cost = &cost
+		}
+
+		if err := d.db.CreateAICall(call); err != nil {
+			log.Errorf(d.ctx, err, "can't record the AI call of %q", feed.RSS_URL)
+		}
+	})
+}
+
+// FindUsage returns the AI usage per day, feed and model since the day of the time
+func (d *deframer) FindUsage(since time.Time) ([]database.Usage, error) {
+	return d.db.FindUsage(database.Day(since))
+}
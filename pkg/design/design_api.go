@@ -0,0 +1,280 @@
+// Package design goa service DSL
+package design
+
+import (
+	. "goa.design/goa/v3/dsl"
+)
+
+var scoreTypes = []any{"clickbait", "framing", "persuasive_intent", "hyper_stimulus"}
+
+var FeedResult = Type("Feed", func() {
+	Description("A deframed feed")
+
+	Attribute("id", UInt, "Feed Id", func() {
+		Example(123)
+	})
+	Attribute("url", String, "URL of the upstream feed")
+	Attribute("title", String, "Title of the feed")
+	Attribute("updated_at", String, "Time of the last change", func() {
+		Format(FormatDateTime)
+	})
+	Attribute("fetched_at", String, "Time of the last successful update, missing if the feed was never fetched", func() {
+		Format(FormatDateTime)
+	})
+	Attribute("status", String, "Status of the last update", func() {
+		Enum("ok", "failed")
+	})
+	Attribute("error", String, "Error of the last failed update")
+	Required("id", "url", "title", "updated_at")
+})
+
+var ScoreResult = Type("Score", func() {
+	Description("An analyzed attribute of an item")
+
+	Attribute("type", String, "Attribute", func() {
+		Enum(scoreTypes...)
+	})
+	Attribute("score", Float64, "Score between 0 and 1")
+	Attribute("reason", String, "Reason for the score")
+	Required("type", "score")
+})
+
+var ItemResult = Type("Item", func() {
+	Description("An analyzed item")
+
+	Attribute("id", UInt, "Item Id")
+	Attribute("feed_url", String, "URL of the upstream feed")
+	Attribute("link", String, "Link of the item")
+	Attribute("guid", String, "Guid of the item")
+	Attribute("language", String, "Language tag (IETF BCP 47) of the item")
+	Attribute("title", String, "Title")
+	Attribute("description", String, "Description")
+	Attribute("title_ai", String, "Neutral title")
+	Attribute("description_ai", String, "Neutral description")
+	Attribute("max_score", Float64, "Highest score")
+	Attribute("scores", ArrayOf(ScoreResult), "Scores")
+	Attribute("created_at", String, "Time of the analysis", func() {
+		Format(FormatDateTime)
+	})
+	Attribute("updated_at", String, "Time of the last analysis", func() {
+		Format(FormatDateTime)
+	})
+	Required("id", "feed_url", "link", "guid", "title", "description", "scores", "created_at", "updated_at")
+})
+
+var ItemListResult = Type("ItemList", func() {
+	Description("A page of items")
+
+	Attribute("items", ArrayOf(ItemResult), "Items, newest first")
+	Attribute("next_cursor", String, "Cursor of the next page, missing on the last page")
+	Required("items")
+})
+
+var LookupResult = Type("PageLookup", func() {
+	Description("The analyzed item of a page url")
+
+	Attribute("url", String, "Page url as requested")
+	Attribute("item", ItemResult, "Newest item with the url, missing if the url is unknown")
+	Required("url")
+})
+
+var DomainResult = Type("Domain", func() {
+	Description("A site with analyzed items")
+
+	Attribute("name", String, "Domain name", func() {
+		Example("example.com")
+	})
+	Attribute("items", Int64, "Number of analyzed items")
+	Attribute("average_scores", ArrayOf(ScoreResult), "Average score per attribute")
+	Attribute("updated_at", String, "Time of the last refresh", func() {
+		Format(FormatDateTime)
+	})
+	Required("name", "items", "average_scores", "updated_at")
+})
+
+var UsageResult = Type("DailyUsage", func() {
+	Description("The AI calls of a feed and model on a day")
+
+	Attribute("day", String, "UTC date", func() {
+		Format(FormatDate)
+	})
+	Attribute("feed_url", String, "URL of the upstream feed")
+	Attribute("model", String, "Model of the AI backend")
+	Attribute("calls", Int64, "Number of AI calls")
+	Attribute("failed_calls", Int64, "Number of failed AI calls")
+	Attribute("prompt_tokens", Int64, "Tokens of the prompts")
+	Attribute("completion_tokens", Int64, "Tokens of the completions")
+	Attribute("average_latency_ms", Float64, "Average latency in milliseconds")
+	Attribute("cost", Float64, "Cost from the price table, missing without a price of the model")
+	Required("day", "feed_url", "model", "calls", "failed_calls", "prompt_tokens", "completion_tokens", "average_latency_ms")
+})
+
+var _ = Service("api", func() {
+	Description("JSON API for the feeds and the analyzed items")
+
+	Error("invalid_cursor", String, "Invalid Cursor")
+	Error("unknown_url", String, "Unknown URL")
+
+	HTTP(func() {
+		Path("/api")
+		Response("invalid_cursor", StatusBadRequest)
+		Response("unknown_url", StatusNotFound)
+	})
+
+	Method("feeds", func() {
+		Description("Lists the deframed feeds")
+
+		Result(ArrayOf(FeedResult))
+
+		HTTP(func() {
+			GET("/feeds")
+			Response(StatusOK)
+		})
+	})
+
+	Method("items", func() {
+		Description("Lists the analyzed items, newest first")
+
+		Payload(func() {
+			Attribute("feed_url", String, "URL of the upstream feed", func() {
+				Example("https://rss.nytimes.com/services/xml/rss/nyt/World.xml")
+			})
+			Attribute("lang", String, "Language tag (IETF BCP 47) of the items", func() {
+				Example("de")
+			})
+			Attribute("since", String, "Items analyzed at or after", func() {
+				Format(FormatDateTime)
+			})
+			Attribute("until", String, "Items analyzed before", func() {
+				Format(FormatDateTime)
+			})
+			Attribute("score_type", String, "Attribute the score thresholds apply to, all attributes if missing", func() {
+				Enum(scoreTypes...)
+			})
+			Attribute("min_score", Float64, "Items with a score of at least min_score", func() {
+				Minimum(0)
+				Maximum(1)
+				Example(0.5)
+			})
+			Attribute("max_score", Float64, "Items without a score above max_score", func() {
+				Minimum(0)
+				Maximum(1)
+				Example(0.5)
+			})
+			Attribute("cursor", String, "Cursor of the page, from next_cursor")
+			Attribute("limit", Int, "Maximum number of items", func() {
+				Minimum(1)
+				Maximum(500)
+				Default(50)
+			})
+		})
+
+		Result(ItemListResult)
+
+		HTTP(func() {
+			GET("/items")
+			Param("feed_url")
+			Param("lang")
+			Param("since")
+			Param("until")
+			Param("score_type")
+			Param("min_score")
+			Param("max_score")
+			Param("cursor")
+			Param("limit")
+			Response(StatusOK)
+		})
+
+		Error("invalid_cursor")
+	})
+
+	Method("lookup", func() {
+		Description("Returns the analyzed item of a page url, the url is canonicalized")
+
+		Payload(func() {
+			Attribute("url", String, "Page url", func() {
+				Example("https://www.example.com/foo?utm_source=rss")
+			})
+			Required("url")
+		})
+
+		Result(ItemResult)
+
+		HTTP(func() {
+			GET("/lookup")
+			Param("url")
+			Response(StatusOK)
+		})
+
+		Error("unknown_url")
+	})
+
+	Method("lookup_batch", func() {
+		Description("Returns the analyzed items of page urls, e.g. all links of a page")
+
+		Payload(func() {
+			Attribute("urls", ArrayOf(String), "Page urls", func() {
+				MaxLength(500)
+			})
+			Required("urls")
+		})
+
+		Result(ArrayOf(LookupResult))
+
+		HTTP(func() {
+			POST("/lookup")
+			Response(StatusOK)
+		})
+	})
+
+	Method("domains", func() {
+		Description("Lists the domains with analyzed items, refreshed after each feed update")
+
+		Result(ArrayOf(DomainResult))
+
+		HTTP(func() {
+			GET("/domains")
+			Response(StatusOK)
+		})
+	})
+
+	Method("usage", func() {
+		Description("Lists the AI token usage per day, feed and model, newest day first")
+
+		Payload(func() {
+			Attribute("days", Int, "Number of days including today", func() {
+				Minimum(1)
+				Maximum(366)
+				Default(7)
+			})
+		})
+
+		Result(ArrayOf(UsageResult))
+
+		HTTP(func() {
+			GET("/usage")
+			Param("days")
+			Response(StatusOK)
+		})
+	})
+
+	Method("filter_list", func() {
+		Description("Returns the domains with analyzed items as uBlock Origin / AdGuard filter list of marker rules")
+
+		HTTP(func() {
+			GET("/domains/filter.txt")
+			SkipResponseBodyEncodeDecode()
+			Response(func() {
+				Header("length:Content-Length") // Map length to Content-Length header
+				Header("type:Content-Type")     // Map type to Content-Type header
+			})
+		})
+
+		Result(func() {
+			// We'll return the file size in the Content-Length header
+			Attribute("length", Int64, "Content length in bytes")
+			Attribute("type", String, "Content type")
+			Required("length", "type")
+		})
+	})
+})
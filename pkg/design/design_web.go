@@ -9,9 +9,13 @@ var _ = Service("web", func() {
 	Description("Web service that returns HTML content")
 
 	Error("invalid_feed_id", String, "Invalid Feed Id")
+	Error("invalid_url", String, "Invalid URL")
+	Error("unknown_language", String, "No prompt for the language")
 
 	HTTP(func() {
 		Response("invalid_feed_id", StatusNotFound)
+		Response("invalid_url", StatusBadRequest)
+		Response("unknown_language", StatusBadRequest)
 	})
 
 	Method("index", func() {
@@ -28,17 +32,44 @@ var _ = Service("web", func() {
 	})
 
 	Method("feed", func() {
-		Description("Returns the feed with the given xml")
+		Description("Returns the feed with the given id as rss, atom or json feed")
 
 		Payload(func() {
 			Attribute("feed_id", UInt, "Feed Id", func() {
 				Example(123)
 			})
+			Attribute("embedded", Boolean, "Replace the content instead of appending metadata", func() {
+				Default(true)
+			})
+			Attribute("max_score", Float64, "Items with a higher score are filtered", func() {
+				Minimum(0)
+				Maximum(1)
+				Example(0.5)
+			})
+			Attribute("score_type", String, "Attribute max_score applies to, the highest score if missing", func() {
+				Enum(scoreTypes...)
+			})
+			Attribute("placeholder", Boolean, "Replace the filtered items with a summary item", func() {
+				Default(false)
+			})
+			Attribute("format", String, "Output format, overrides the Accept header", func() {
+				Enum("rss", "atom", "json")
+				Example("atom")
+			})
+			Attribute("accept", String, "Accept header", func() {
+				Example("application/atom+xml")
+			})
 			Required("feed_id")
 		})
 
 		HTTP(func() {
 			GET("/feed/{feed_id}")
+			Param("embedded")
+			Param("max_score")
+			Param("score_type")
+			Param("placeholder")
+			Param("format")
+			Header("accept:Accept")
 			SkipResponseBodyEncodeDecode()
 			Response(func() {
 				Header("length:Content-Length") // Map length to Content-Length header
@@ -56,4 +87,67 @@ var _ = Service("web", func() {
 		})
 
 	})
+
+	Method("proxy", func() {
+		Description("Deframes the feed with the given url and returns it as rss, atom or json feed")
+
+		Payload(func() {
+			Attribute("url", String, "URL of the upstream feed", func() {
+				Format(FormatURI)
+				Example("https://rss.nytimes.com/services/xml/rss/nyt/World.xml")
+			})
+			Attribute("lang", String, "Language tag (IETF BCP 47) of a new feed, the upstream language if missing", func() {
+				Example("de-DE")
+			})
+			Attribute("max_score", Float64, "Items with a higher score are filtered", func() {
+				Minimum(0)
+				Maximum(1)
+				Example(0.5)
+			})
+			Attribute("score_type", String, "Attribute max_score applies to, the highest score if missing", func() {
+				Enum(scoreTypes...)
+			})
+			Attribute("placeholder", Boolean, "Replace the filtered items with a summary item", func() {
+				Default(false)
+			})
+			Attribute("embedded", Boolean, "Replace the content instead of appending metadata", func() {
+				Default(false)
+			})
+			Attribute("format", String, "Output format, overrides the Accept header", func() {
+				Enum("rss", "atom", "json")
+				Example("atom")
+			})
+			Attribute("accept", String, "Accept header", func() {
+				Example("application/atom+xml")
+			})
+			Required("url")
+		})
+
+		HTTP(func() {
+			GET("/proxy")
+			Param("url")
+			Param("lang")
+			Param("max_score")
+			Param("score_type")
+			Param("placeholder")
+			Param("embedded")
+			Param("format")
+			Header("accept:Accept")
+			SkipResponseBodyEncodeDecode()
+			Response(func() {
+				Header("length:Content-Length") // Map length to Content-Length header
+				Header("type:Content-Type")     // Map type to Content-Type header
+			})
+		})
+
+		Error("invalid_url")
+		Error("unknown_language")
+
+		Result(func() {
+			// We'll return the file size in the Content-Length header
+			Attribute("length", Int64, "Content length in bytes")
+			Attribute("type", String, "Content type")
+			Required("length", "type")
+		})
+	})
 })
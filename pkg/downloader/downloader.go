@@ -1,61 +1,250 @@
 package downloader
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"strings"
+	"syscall"
 	"time"
 )
 
+const timeout = 15 * time.Second
+
+// ErrNotPublic is returned by the proxy downloader for urls that aren't on a public address
+var ErrNotPublic = errors.New("not a public address")
+
+// ErrTooLarge is returned for feeds above the maximum size
+var ErrTooLarge = errors.New("feed is too large")
+
 type downloader struct {
+	maxSize int64 // bytes, 0 is unlimited
+	public  bool  // only http urls of public addresses
+	client  *http.Client
+}
+
+// Validators of a previous download, used for a conditional request
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+// Download is the result of a conditional request
+type Download struct {
+	Data        string
+	Validators  Validators
+	NotModified bool // the feed didn't change since the previous download
 }
 
 type Downloader interface {
 	DownloadRSSFeed(feed string) (string, error)
+	DownloadRSSFeedConditional(feed string, validators Validators) (*Download, error)
+}
+
+// NewDownloader initializes a new downloader for urls and local files up to maxSize bytes, 0 is unlimited
+func NewDownloader(maxSize int64) Downloader {
+	res := &downloader{
+		maxSize: maxSize,
+		client:  &http.Client{Timeout: timeout},
+	}
+
+	return res
 }
 
-// NewDownloader initializes a new downloader
-func NewDownloader() Downloader {
-	res := &downloader{}
+// NewProxyDownloader initializes a downloader for urls of untrusted users. Only http urls
+// of public addresses are downloaded, the addresses are checked again on each connection,
+// so redirects and changed DNS records can't reach local services.
+func NewProxyDownloader(maxSize int64) Downloader {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: checkDial,
+	}
+
+	res := &downloader{
+		maxSize: maxSize,
+		public:  true,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				// a proxy would be the checked address
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   timeout,
+				ResponseHeaderTimeout: timeout,
+				MaxIdleConns:          10,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+	}
 
 	return res
 }
 
 func (d *downloader) DownloadRSSFeed(feed string) (string, error) {
+	res, err := d.DownloadRSSFeedConditional(feed, Validators{})
+	if err != nil {
+		return "", err
+	}
+	return res.Data, nil
+}
+
+func (d *downloader) DownloadRSSFeedConditional(feed string, validators Validators) (*Download, error) {
 	if feed == "" {
-		return "", errors.New("feed cannot be empty")
+		return nil, errors.New("feed cannot be empty")
+	}
+
+	if d.public {
+		if err := checkURL(feed); err != nil {
+			return nil, err
+		}
 	}
 
 	switch {
 	case strings.HasPrefix(feed, "http://") || strings.HasPrefix(feed, "https://"):
 		// HTTP download
-		client := &http.Client{Timeout: 15 * time.Second}
-		resp, err := client.Get(feed)
+		req, err := http.NewRequest(http.MethodGet, feed, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request for URL %q: %w", feed, err)
+		}
+
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+
+		resp, err := d.client.Do(req)
 		if err != nil {
-			return "", fmt.Errorf("failed to fetch URL %q: %w", feed, err)
+			return nil, fmt.Errorf("failed to fetch URL %q: %w", feed, err)
 		}
 		defer resp.Body.Close()
 
+		if resp.StatusCode == http.StatusNotModified {
+			return &Download{
+				Validators:  validators,
+				NotModified: true,
+			}, nil
+		}
+
 		if resp.StatusCode != http.StatusOK {
-			return "", fmt.Errorf("HTTP request failed: %s", resp.Status)
+			return nil, fmt.Errorf("HTTP request failed: %s", resp.Status)
 		}
 
-		data, err := io.ReadAll(resp.Body)
+		data, err := d.read(resp.Body)
 		if err != nil {
-			return "", fmt.Errorf("failed to read HTTP response: %w", err)
+			return nil, fmt.Errorf("failed to read HTTP response of URL %q: %w", feed, err)
 		}
-		return string(data), nil
+
+		return &Download{
+			Data: string(data),
+			Validators: Validators{
+				ETag:         resp.Header.Get("ETag"),
+				LastModified: resp.Header.Get("Last-Modified"),
+			},
+		}, nil
 
 	default:
 		// Local file handling (with or without file:// prefix)
 		path := strings.TrimPrefix(feed, "file://")
-		data, err := os.ReadFile(path)
+		file, err := os.Open(path)
 		if err != nil {
-			return "", fmt.Errorf("failed to read file %q: %w", path, err)
+			return nil, fmt.Errorf("failed to read file %q: %w", path, err)
+		}
+		defer file.Close()
+
+		data, err := d.read(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %q: %w", path, err)
+		}
+		return &Download{Data: string(data)}, nil
+	}
+}
+
+// read reads up to the maximum size
+func (d *downloader) read(r io.Reader) ([]byte, error) {
+	if d.maxSize <= 0 {
+		return io.ReadAll(r)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, d.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > d.maxSize {
+		return nil, fmt.Errorf("%w: more than %v bytes", ErrTooLarge, d.maxSize)
+	}
+	return data, nil
+}
+
+// checkURL rejects urls that aren't http or resolve to an address that isn't public
+func checkURL(feed string) error {
+	u, err := url.Parse(feed)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("%w: %q is not a http url", ErrNotPublic, feed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return fmt.Errorf("failed to resolve %q: %w", u.Hostname(), err)
+	}
+
+	for _, addr := range addrs {
+		if !isPublic(addr) {
+			return fmt.Errorf("%w: %q resolves to %v", ErrNotPublic, u.Hostname(), addr)
+		}
+	}
+	return nil
+}
+
+// checkDial rejects connections to addresses that aren't public, this implements net.Dialer.Control
+func checkDial(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+
+	if !isPublic(addr) {
+		return fmt.Errorf("%w: %v", ErrNotPublic, addr)
+	}
+	return nil
+}
+
+// nonPublic are the special purpose ranges not covered by the netip methods
+var nonPublic = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // this network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved and broadcast
+}
+
+// isPublic reports if the address is a public unicast address. Loopback, private,
+// link-local (e.g. cloud metadata services) and other special addresses are not.
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+
+	for _, prefix := range nonPublic {
+		if prefix.Contains(addr) {
+			return false
 		}
-		return string(data), nil
 	}
+	return true
 }
@@ -6,6 +6,7 @@ import (
 	_ "embed"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"testing"
@@ -14,12 +15,12 @@ import (
 )
 
 func TestNewDownloader(t *testing.T) {
-	d := NewDownloader()
+	d := NewDownloader(0)
 	assert.NotNil(t, d, "Downloader should be initialized")
 }
 
 func TestNewUpdateFeeds(t *testing.T) {
-	d := NewDownloader()
+	d := NewDownloader(0)
 	assert.NotNil(t, d, "Downloader should be initialized")
 
 	tests := []struct {
@@ -108,3 +109,109 @@ func TestNewUpdateFeeds(t *testing.T) {
 		})
 	}
 }
+
+func TestDownloadRSSFeedConditional(t *testing.T) {
+	d := NewDownloader(0)
+
+	const etag = `"v1"`
+	const lastModified = "Fri, 01 Aug 2025 10:41:20 GMT"
+	expected := "<rss>http feed</rss>"
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte(expected))
+	}))
+	t.Cleanup(ts.Close)
+
+	// first download
+	res, err := d.DownloadRSSFeedConditional(ts.URL, Validators{})
+	assert.NoError(t, err)
+	assert.False(t, res.NotModified)
+	assert.Equal(t, expected, res.Data)
+	assert.Equal(t, etag, res.Validators.ETag)
+	assert.Equal(t, lastModified, res.Validators.LastModified)
+
+	// unchanged
+	res, err = d.DownloadRSSFeedConditional(ts.URL, res.Validators)
+	assert.NoError(t, err)
+	assert.True(t, res.NotModified)
+	assert.Empty(t, res.Data)
+	assert.Equal(t, etag, res.Validators.ETag)
+}
+
+func TestMaxSize(t *testing.T) {
+	d := NewDownloader(10)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Query().Get("body")))
+	}))
+	t.Cleanup(ts.Close)
+
+	data, err := d.DownloadRSSFeed(ts.URL + "?body=0123456789")
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", data)
+
+	_, err = d.DownloadRSSFeed(ts.URL + "?body=0123456789a")
+	assert.ErrorIs(t, err, ErrTooLarge)
+
+	tmpFile := filepath.Join(t.TempDir(), "large.xml")
+	assert.NoError(t, os.WriteFile(tmpFile, []byte("<rss>large file</rss>"), 0644))
+	_, err = d.DownloadRSSFeed(tmpFile)
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
+
+func TestProxyDownloader(t *testing.T) {
+	d := NewProxyDownloader(0)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<rss>local feed</rss>"))
+	}))
+	t.Cleanup(ts.Close)
+
+	for _, feed := range []string{
+		ts.URL,
+		"http://localhost/rss",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/rss",
+		"http://10.0.0.1/rss",
+		"file:///etc/passwd",
+		"/etc/passwd",
+	} {
+		_, err := d.DownloadRSSFeed(feed)
+		assert.ErrorIs(t, err, ErrNotPublic, feed)
+	}
+
+	// redirects and changed DNS records are checked on connect
+	assert.ErrorIs(t, checkDial("tcp", "127.0.0.1:80", nil), ErrNotPublic)
+	assert.ErrorIs(t, checkDial("tcp", "[fd00:ec2::254]:80", nil), ErrNotPublic)
+	assert.NoError(t, checkDial("tcp", "93.184.215.14:443", nil))
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.215.14":        true,
+		"2606:2800:21f:cb07::": true,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"100.64.0.1":           false,
+		"0.0.0.0":              false,
+		"255.255.255.255":      false,
+		"::1":                  false,
+		"fe80::1":              false,
+		"fd00::1":              false,
+		"::ffff:127.0.0.1":     false,
+		"::ffff:93.184.215.14": true,
+	}
+
+	for addr, expected := range tests {
+		assert.Equal(t, expected, isPublic(netip.MustParseAddr(addr)), addr)
+	}
+}
@@ -12,6 +12,7 @@ package mock_downloader
 import (
 	reflect "reflect"
 
+	downloader "github.com/egandro/news-deframer/pkg/downloader"
 	gomock "go.uber.org/mock/gomock"
 )
 
@@ -53,3 +54,18 @@ func (mr *MockDownloaderMockRecorder) DownloadRSSFeed(feed any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DownloadRSSFeed", reflect.TypeOf((*MockDownloader)(nil).DownloadRSSFeed), feed)
 }
+
+// DownloadRSSFeedConditional mocks base method.
+func (m *MockDownloader) DownloadRSSFeedConditional(feed string, validators downloader.Validators) (*downloader.Download, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DownloadRSSFeedConditional", feed, validators)
+	ret0, _ := ret[0].(*downloader.Download)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DownloadRSSFeedConditional indicates an expected call of DownloadRSSFeedConditional.
+func (mr *MockDownloaderMockRecorder) DownloadRSSFeedConditional(feed, validators any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DownloadRSSFeedConditional", reflect.TypeOf((*MockDownloader)(nil).DownloadRSSFeedConditional), feed, validators)
+}
@@ -0,0 +1,160 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidOutput is returned when the model output doesn't match the analysis schema
+var ErrInvalidOutput = errors.New("invalid model output")
+
+// Analysis is the typed result of an item analysis, attributes the model didn't return are nil
+type Analysis struct {
+	TitleCorrected       *string  `json:"title_corrected"`
+	DescriptionCorrected *string  `json:"description_corrected"`
+	Clickbait            *float64 `json:"clickbait"`
+	Framing              *float64 `json:"framing"`
+	PersuasiveIntent     *float64 `json:"persuasive_intent"`
+	HyperStimulus        *float64 `json:"hyper_stimulus"`
+	ReasonClickbait      *string  `json:"reason_clickbait"`
+	ReasonFraming        *string  `json:"reason_framing"`
+	ReasonPersuasive     *string  `json:"reason_persuasive"`
+	ReasonStimulus       *string  `json:"reason_stimulus"`
+}
+
+// analysisName names the schema and the tool of the analysis
+const analysisName = "item_analysis"
+
+// analysisSchema is the JSON schema of the analysis attributes. Strict modes require all attributes,
+// a score that doesn't apply is null.
+var analysisSchema = json.RawMessage(`{
+	"type": "object",
+	"properties": {
+		"title_corrected": {"type": "string", "description": "the corrected, objective title"},
+		"description_corrected": {"type": "string", "description": "the corrected, objective description"},
+		"clickbait": {"type": ["number", "null"], "minimum": 0, "maximum": 1},
+		"framing": {"type": ["number", "null"], "minimum": 0, "maximum": 1},
+		"persuasive_intent": {"type": ["number", "null"], "minimum": 0, "maximum": 1},
+		"hyper_stimulus": {"type": ["number", "null"], "minimum": 0, "maximum": 1},
+		"reason_clickbait": {"type": ["string", "null"]},
+		"reason_framing": {"type": ["string", "null"]},
+		"reason_persuasive": {"type": ["string", "null"]},
+		"reason_stimulus": {"type": ["string", "null"]}
+	},
+	"required": [
+		"title_corrected", "description_corrected",
+		"clickbait", "framing", "persuasive_intent", "hyper_stimulus",
+		"reason_clickbait", "reason_framing", "reason_persuasive", "reason_stimulus"
+	],
+	"additionalProperties": false
+}`)
+
+// analysisRequired are the attributes the schema requires
+var analysisRequired = func() []string {
+	var schema struct {
+		Required []string `json:"required"`
+	}
+	if err := json.Unmarshal(analysisSchema, &schema); err != nil {
+		panic(err)
+	}
+	return schema.Required
+}()
+
+// ParseAnalysis parses the free text answer of a model, e.g. JSON in a markdown code block.
+// Unknown attributes are ignored, prompts with only a framing score may use "reason".
+func ParseAnalysis(input string) (*Analysis, error) {
+	data, err := extractJSON(input)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidOutput, err)
+	}
+	return decodeAnalysis(data, false)
+}
+
+// decodeAnalysis decodes and validates the attributes, strict rejects unknown and missing attributes
+func decodeAnalysis(data []byte, strict bool) (*Analysis, error) {
+	var res struct {
+		Analysis
+		Reason *string `json:"reason"`
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(&res); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("%w: %q is a %v, not a %v", ErrInvalidOutput, typeErr.Field, typeErr.Value, typeErr.Type)
+		}
+		return nil, fmt.Errorf("%w: %w", ErrInvalidOutput, err)
+	}
+
+	if strict {
+		if err := checkRequired(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if res.ReasonFraming == nil {
+		res.ReasonFraming = res.Reason
+	}
+
+	if err := res.Analysis.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &res.Analysis, nil
+}
+
+// checkRequired checks that the output has all attributes the schema requires
+func checkRequired(data []byte) error {
+	var attributes map[string]json.RawMessage
+	if err := json.Unmarshal(data, &attributes); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidOutput, err)
+	}
+
+	var missing []string
+	for _, name := range analysisRequired {
+		if _, ok := attributes[name]; !ok {
+			missing = append(missing, fmt.Sprintf("%q", name))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: missing %v", ErrInvalidOutput, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// Validate checks the scores, at least one score in the range 0.0 to 1.0 is required
+func (a *Analysis) Validate() error {
+	scores := []struct {
+		name  string
+		score *float64
+	}{
+		{"clickbait", a.Clickbait},
+		{"framing", a.Framing},
+		{"persuasive_intent", a.PersuasiveIntent},
+		{"hyper_stimulus", a.HyperStimulus},
+	}
+
+	found := false
+	for _, s := range scores {
+		if s.score == nil {
+			continue
+		}
+		if *s.score < 0 || *s.score > 1 {
+			return fmt.Errorf("%w: %q is %v, not in the range 0.0 to 1.0", ErrInvalidOutput, s.name, *s.score)
+		}
+		found = true
+	}
+
+	if !found {
+		return fmt.Errorf("%w: no score", ErrInvalidOutput)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package openai
+
+import (
+	"context"
+)
+
+type limitedAI struct {
+	OpenAI
+	slots chan struct{}
+}
+
+// NewLimitedAI limits the number of concurrent queries to an AI backend
+func NewLimitedAI(ai OpenAI, limit int) OpenAI {
+	if limit < 1 {
+		limit = 1
+	}
+
+	return &limitedAI{
+		OpenAI: ai,
+		slots:  make(chan struct{}, limit),
+	}
+}
+
+func (a *limitedAI) Analyze(ctx context.Context, user string, system string) (*Analysis, error) {
+	select {
+	case a.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-a.slots }()
+
+	return a.OpenAI.Analyze(ctx, user, system)
+}
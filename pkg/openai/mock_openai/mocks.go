@@ -13,6 +13,7 @@ import (
 	context "context"
 	reflect "reflect"
 
+	openai "github.com/egandro/news-deframer/pkg/openai"
 	gomock "go.uber.org/mock/gomock"
 )
 
@@ -40,32 +41,17 @@ func (m *MockOpenAI) EXPECT() *MockOpenAIMockRecorder {
 	return m.recorder
 }
 
-// FuzzyParseJSON mocks base method.
-func (m *MockOpenAI) FuzzyParseJSON(input string) (any, error) {
+// Analyze mocks base method.
+func (m *MockOpenAI) Analyze(ctx context.Context, user, system string) (*openai.Analysis, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FuzzyParseJSON", input)
-	ret0, _ := ret[0].(any)
+	ret := m.ctrl.Call(m, "Analyze", ctx, user, system)
+	ret0, _ := ret[0].(*openai.Analysis)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// FuzzyParseJSON indicates an expected call of FuzzyParseJSON.
-func (mr *MockOpenAIMockRecorder) FuzzyParseJSON(input any) *gomock.Call {
+// Analyze indicates an expected call of Analyze.
+func (mr *MockOpenAIMockRecorder) Analyze(ctx, user, system any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FuzzyParseJSON", reflect.TypeOf((*MockOpenAI)(nil).FuzzyParseJSON), input)
-}
-
-// Query mocks base method.
-func (m *MockOpenAI) Query(ctx context.Context, user, system string) (string, error) {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Query", ctx, user, system)
-	ret0, _ := ret[0].(string)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
-}
-
-// Query indicates an expected call of Query.
-func (mr *MockOpenAIMockRecorder) Query(ctx, user, system any) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Query", reflect.TypeOf((*MockOpenAI)(nil).Query), ctx, user, system)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Analyze", reflect.TypeOf((*MockOpenAI)(nil).Analyze), ctx, user, system)
 }
@@ -4,72 +4,192 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	openai "github.com/sashabaranov/go-openai"
 )
 
+// OutputMode selects how the analysis is requested from the model
+type OutputMode string
+
+const (
+	OutputJSONSchema OutputMode = "json_schema" // response_format with the analysis schema
+	OutputTools      OutputMode = "tools"       // a forced call of a tool with the analysis schema
+	OutputText       OutputMode = "text"        // the prompt asks for JSON, the answer is parsed leniently
+)
+
+// fallback is the next mode of servers that reject a mode
+var fallback = map[OutputMode]OutputMode{
+	OutputJSONSchema: OutputTools,
+	OutputTools:      OutputText,
+}
+
 type openAI struct {
 	client *openai.Client
 	model  string
+	mode   atomic.Value // OutputMode, downgraded when the server rejects it
 }
 
 // OpenAI handles AI operation
 type OpenAI interface {
-	Query(ctx context.Context, user string, system string) (string, error)
-	FuzzyParseJSON(input string) (interface{}, error)
+	Analyze(ctx context.Context, user string, system string) (*Analysis, error)
 }
 
-// NewAI
-func NewAI(url string, model string, token string) OpenAI {
+// NewAI connects to an OpenAI compatible API, the OpenAI API if the url is empty
+func NewAI(url string, model string, token string, mode OutputMode) OpenAI {
 	res := &openAI{
 		model: model,
 	}
 
-	if token != "" {
-		// openai
-		res.client = openai.NewClient(token)
-	} else {
-		// LM Studio or similar
-		config := openai.DefaultConfig("")
+	if mode == "" {
+		mode = OutputJSONSchema
+	}
+	res.mode.Store(mode)
+
+	// LM Studio or Ollama without a token, OpenAI or compatible services with a token
+	config := openai.DefaultConfig(token)
+	if url != "" {
 		config.BaseURL = url
-		// Optional: use a custom HTTP client (e.g., no TLS verification)
-		config.HTTPClient = &http.Client{}
-		res.client = openai.NewClientWithConfig(config)
 	}
+	// Optional: use a custom HTTP client (e.g., no TLS verification)
+	config.HTTPClient = &http.Client{}
+	res.client = openai.NewClientWithConfig(config)
 
 	return res
 }
 
-func (a *openAI) Query(ctx context.Context, user string, system string) (string, error) {
-	resp, err := a.client.CreateChatCompletion(
-		ctx,
-		openai.ChatCompletionRequest{
-			Model: a.model,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: system,
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: user,
-				},
+// Analyze requests the analysis in the current output mode. A mode the server rejects
+// falls back to the next one, which is kept once it worked.
+func (a *openAI) Analyze(ctx context.Context, user string, system string) (*Analysis, error) {
+	mode := a.mode.Load().(OutputMode)
+
+	for {
+		res, err := a.analyze(ctx, user, system, mode)
+
+		next, ok := fallback[mode]
+		if !ok || !unsupported(err) {
+			if err == nil || errors.Is(err, ErrInvalidOutput) {
+				// the server accepted the mode
+				a.mode.Store(mode)
+			}
+			return res, err
+		}
+
+		mode = next
+	}
+}
+
+func (a *openAI) analyze(ctx context.Context, user string, system string, mode OutputMode) (*Analysis, error) {
+	req := a.request(user, system)
+
+	switch mode {
+	case OutputJSONSchema:
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   analysisName,
+				Schema: analysisSchema,
+				Strict: true,
 			},
-		},
-	)
+		}
+	case OutputTools:
+		req.Tools = []openai.Tool{{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        analysisName,
+				Description: "Reports the analysis of the item",
+				Strict:      true,
+				Parameters:  analysisSchema,
+			},
+		}}
+		req.ToolChoice = openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: analysisName},
+		}
+	case OutputText:
+	default:
+		return nil, fmt.Errorf("unknown output mode %q", mode)
+	}
 
+	resp, err := a.complete(ctx, req)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("%w: no choices", ErrInvalidOutput)
+	}
+	msg := resp.Choices[0].Message
+
+	switch mode {
+	case OutputJSONSchema:
+		return decodeAnalysis([]byte(msg.Content), true)
+	case OutputTools:
+		for _, call := range msg.ToolCalls {
+			if call.Function.Name == analysisName {
+				return decodeAnalysis([]byte(call.Function.Arguments), true)
+			}
+		}
+		return nil, fmt.Errorf("%w: no call of %q", ErrInvalidOutput, analysisName)
+	default:
+		return ParseAnalysis(msg.Content)
+	}
+}
+
+// complete sends the request and reports the usage
+func (a *openAI) complete(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	start := time.Now()
+	resp, err := a.client.CreateChatCompletion(ctx, req)
+
+	reportUsage(ctx, Usage{
+		Model:            a.model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+		Latency:          time.Since(start),
+		Err:              err,
+	})
+
+	return resp, err
+}
+
+func (a *openAI) request(user string, system string) openai.ChatCompletionRequest {
+	return openai.ChatCompletionRequest{
+		Model: a.model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: system,
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: user,
+			},
+		},
+	}
+}
+
+// unsupported reports if the server rejected the request, e.g. an unknown response_format
+func unsupported(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode == http.StatusBadRequest || apiErr.HTTPStatusCode == http.StatusUnprocessableEntity
+	}
+
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode == http.StatusBadRequest || reqErr.HTTPStatusCode == http.StatusUnprocessableEntity
 	}
 
-	return resp.Choices[0].Message.Content, nil
+	return false
 }
 
-func (a *openAI) FuzzyParseJSON(input string) (interface{}, error) {
+// extractJSON returns the first JSON value of the input
+func extractJSON(input string) (json.RawMessage, error) {
 	cleaned := cleanInput(input)
 
 	// Step 1: Try to isolate the part where JSON begins
@@ -82,9 +202,8 @@ func (a *openAI) FuzzyParseJSON(input string) (interface{}, error) {
 
 	// Step 2: Use a decoder to extract a single JSON value
 	dec := json.NewDecoder(bytes.NewReader([]byte(jsonCandidate)))
-	dec.UseNumber() // keeps numbers flexible
 
-	var result interface{}
+	var result json.RawMessage
 	if err := dec.Decode(&result); err != nil {
 		return nil, fmt.Errorf("error decoding JSON: %w", err)
 	}
@@ -4,7 +4,14 @@ package openai
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/egandro/news-deframer/pkg/config"
 	"github.com/joho/godotenv"
@@ -15,7 +22,7 @@ func init() {
 	_ = godotenv.Load("../../.env")
 }
 
-func TestQuery(t *testing.T) {
+func TestAnalyzeLMStudio(t *testing.T) {
 	t.Skip("this requires a LM-Studio connection")
 	ctx := context.Background()
 
@@ -23,27 +30,301 @@ func TestQuery(t *testing.T) {
 	assert.NoError(t, err)
 
 	const user = `
-		Create 10 cat names.
-		Strictly return it as json array. Sample: ["name1", "name2"]`
-	const system = "You are a cat name expert."
+		Rate the framing of the headline "Government finally admits its failure" from 0.0 to 1.0.
+		Strictly return it as json. Sample: { "framing": 0.5, "reason": "My Reason" }`
+	const system = "You are a media analyst."
 
-	ai := NewAI(cfg.AI_URL, cfg.AI_Model, "")
+	ai := NewAI(cfg.AI_URL, cfg.AI_Model, "", OutputText)
 	assert.NotNil(t, ai)
 
-	res, err := ai.Query(ctx, user, system)
+	res, err := ai.Analyze(ctx, user, system)
 	assert.NoError(t, err)
-	assert.NotEqual(t, res, "")
+	assert.NotNil(t, res.Framing)
 }
 
-func TestFuzzyParseJSON(t *testing.T) {
+func TestExtractJSON(t *testing.T) {
 	input := `json
 
 	[
 		"Whiskers Shadow", "Mittens Blaze", "Shadow Purrfect", "Midnight Whisker", "Aurora Claw", "Sapphire Meowster", "Basil Flufftail", "Glimmer Paw", "Twilight Velvet", "Cocoa Munchkin"
-	]
+	] trailing text
 `
-	ai := NewAI("", "", "")
-	parsed, err := ai.FuzzyParseJSON(input)
+	parsed, err := extractJSON(input)
 	assert.NoError(t, err)
-	assert.NotNil(t, parsed)
+	var names []string
+	assert.NoError(t, json.Unmarshal(parsed, &names))
+	assert.Len(t, names, 10)
+}
+
+func TestParseAnalysis(t *testing.T) {
+	res, err := ParseAnalysis("```json\n{ \"title_corrected\": \"title\", \"framing\": 0.2, \"reason\": \"My Reason\", \"mood\": \"calm\" }\n```")
+	assert.NoError(t, err)
+	assert.Equal(t, "title", *res.TitleCorrected)
+	assert.Equal(t, 0.2, *res.Framing)
+	assert.Equal(t, "My Reason", *res.ReasonFraming, "reason is the framing reason")
+	assert.Nil(t, res.Clickbait)
+
+	_, err = ParseAnalysis(`{ "framing": "high" }`)
+	assert.ErrorIs(t, err, ErrInvalidOutput)
+	assert.ErrorContains(t, err, `"framing" is a string, not a float64`)
+
+	_, err = ParseAnalysis(`{ "framing": 1.5 }`)
+	assert.ErrorIs(t, err, ErrInvalidOutput)
+	assert.ErrorContains(t, err, `"framing" is 1.5`)
+
+	_, err = ParseAnalysis(`{ "title_corrected": "title" }`)
+	assert.ErrorIs(t, err, ErrInvalidOutput)
+
+	_, err = ParseAnalysis("no json")
+	assert.ErrorIs(t, err, ErrInvalidOutput)
+
+	_, err = decodeAnalysis([]byte(`{ "framing": 0.2, "mood": "calm" }`), true)
+	assert.ErrorIs(t, err, ErrInvalidOutput, "the schema has no additional attributes")
+
+	// structured outputs must have all attributes of the schema
+	_, err = decodeAnalysis([]byte(`{ "framing": 0.2, "reason_framing": "My Reason" }`), true)
+	assert.ErrorIs(t, err, ErrInvalidOutput)
+	assert.ErrorContains(t, err, `missing "title_corrected", "description_corrected", "clickbait"`)
+	assert.ErrorContains(t, err, `"reason_stimulus"`)
+	assert.NotContains(t, err.Error(), `"framing"`)
+
+	const complete = `{"title_corrected":"title","description_corrected":"","clickbait":0.1,"framing":0.2,"persuasive_intent":0,"hyper_stimulus":0,"reason_clickbait":"","reason_framing":"My Reason","reason_persuasive":"","reason_stimulus":""}`
+	res, err = decodeAnalysis([]byte(complete), true)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.2, *res.Framing)
+
+	// attributes that don't apply are null
+	const partial = `{"title_corrected":"title","description_corrected":"","clickbait":null,"framing":0.2,"persuasive_intent":null,"hyper_stimulus":null,"reason_clickbait":null,"reason_framing":"My Reason","reason_persuasive":null,"reason_stimulus":null}`
+	res, err = decodeAnalysis([]byte(partial), true)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.2, *res.Framing)
+	assert.Nil(t, res.Clickbait)
+	assert.Nil(t, res.ReasonClickbait)
+
+	var schema struct {
+		Properties map[string]struct {
+			Type any `json:"type"`
+		} `json:"properties"`
+	}
+	assert.NoError(t, json.Unmarshal(analysisSchema, &schema))
+	assert.Equal(t, []any{"number", "null"}, schema.Properties["framing"].Type)
+	assert.Equal(t, []any{"string", "null"}, schema.Properties["reason_framing"].Type)
+}
+
+// chatServer answers chat completions, servers without response_format reject it
+func chatServer(t *testing.T, schema bool, requests *[]map[string]any) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		*requests = append(*requests, req)
+
+		const args = `{"title_corrected":"title","description_corrected":"","clickbait":0.1,"framing":0.2,"persuasive_intent":0,"hyper_stimulus":0,"reason_clickbait":"","reason_framing":"My Reason","reason_persuasive":"","reason_stimulus":""}`
+		message := map[string]any{"role": "assistant", "content": args}
+
+		if _, ok := req["response_format"]; ok && !schema {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"message":"response_format is not supported","type":"invalid_request_error"}}`))
+			return
+		}
+		if _, ok := req["tools"]; ok {
+			message = map[string]any{"role": "assistant", "tool_calls": []any{map[string]any{
+				"id": "call_1", "type": "function",
+				"function": map[string]any{"name": analysisName, "arguments": args},
+			}}}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"choices": []any{map[string]any{"index": 0, "message": message}},
+			"usage":   map[string]any{"prompt_tokens": 120, "completion_tokens": 30, "total_tokens": 150},
+		})
+	}))
+}
+
+func TestAnalyze(t *testing.T) {
+	var requests []map[string]any
+	server := chatServer(t, true, &requests)
+	defer server.Close()
+
+	ai := NewAI(server.URL, "model", "", OutputJSONSchema)
+	res, err := ai.Analyze(context.Background(), "user", "system")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.2, *res.Framing)
+	assert.Equal(t, "My Reason", *res.ReasonFraming)
+
+	assert.Len(t, requests, 1)
+	format := requests[0]["response_format"].(map[string]any)
+	assert.Equal(t, "json_schema", format["type"])
+}
+
+func TestAnalyzeUsage(t *testing.T) {
+	var requests []map[string]any
+	server := chatServer(t, false, &requests)
+	defer server.Close()
+
+	var usage []Usage
+	ctx := WithUsage(context.Background(), func(u Usage) {
+		usage = append(usage, u)
+	})
+
+	ai := NewAI(server.URL, "model", "", OutputJSONSchema)
+	_, err := ai.Analyze(ctx, "user", "system")
+	assert.NoError(t, err)
+
+	// the rejected response_format and the tool call
+	assert.Len(t, usage, 2)
+	assert.Error(t, usage[0].Err)
+	assert.Equal(t, 0, usage[0].PromptTokens)
+	assert.NoError(t, usage[1].Err)
+	assert.Equal(t, "model", usage[1].Model)
+	assert.Equal(t, 120, usage[1].PromptTokens)
+	assert.Equal(t, 30, usage[1].CompletionTokens)
+}
+
+func TestAnalyzeFallback(t *testing.T) {
+	var requests []map[string]any
+	server := chatServer(t, false, &requests)
+	defer server.Close()
+
+	ai := NewAI(server.URL, "model", "", OutputJSONSchema)
+	res, err := ai.Analyze(context.Background(), "user", "system")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.1, *res.Clickbait)
+	assert.Len(t, requests, 2, "the tool call follows the rejected response_format")
+
+	// the working mode is kept
+	_, err = ai.Analyze(context.Background(), "user", "system")
+	assert.NoError(t, err)
+	assert.Len(t, requests, 3)
+	assert.Contains(t, requests[2], "tools")
+	assert.NotContains(t, requests[2], "response_format")
+}
+
+func TestNoChoices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[]}`))
+	}))
+	defer server.Close()
+
+	ai := NewAI(server.URL, "model", "", OutputJSONSchema)
+	_, err := ai.Analyze(context.Background(), "user", "system")
+	assert.ErrorIs(t, err, ErrInvalidOutput)
+}
+
+type slowAI struct {
+	OpenAI
+	running atomic.Int32
+	maximum atomic.Int32
+}
+
+func (a *slowAI) Analyze(ctx context.Context, user string, system string) (*Analysis, error) {
+	current := a.running.Add(1)
+	defer a.running.Add(-1)
+	for {
+		old := a.maximum.Load()
+		if current <= old || a.maximum.CompareAndSwap(old, current) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return &Analysis{TitleCorrected: &user}, nil
+}
+
+func TestLimitedAI(t *testing.T) {
+	backend := &slowAI{}
+	ai := NewLimitedAI(backend, 2)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := ai.Analyze(context.Background(), "user", "system")
+			assert.NoError(t, err)
+			assert.Equal(t, "user", *res.TitleCorrected)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), backend.maximum.Load(), "Only 2 queries should run at once")
+}
+
+func TestLimitedAICancel(t *testing.T) {
+	backend := &slowAI{}
+	ai := NewLimitedAI(backend, 1).(*limitedAI)
+	ai.slots <- struct{}{} // the backend is busy
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := ai.Analyze(ctx, "user", "system")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// failingAI fails until it is healthy again, it counts the queries
+type failingAI struct {
+	OpenAI
+	failing atomic.Bool
+	queries atomic.Int32
+}
+
+func (a *failingAI) Analyze(ctx context.Context, user string, system string) (*Analysis, error) {
+	a.queries.Add(1)
+	if a.failing.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return &Analysis{TitleCorrected: &user}, nil
+}
+
+// hangingAI answers when the context is done
+type hangingAI struct {
+	OpenAI
+}
+
+func (a *hangingAI) Analyze(ctx context.Context, user string, system string) (*Analysis, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRouter(t *testing.T) {
+	local := &failingAI{}
+	local.failing.Store(true)
+	cloud := &failingAI{}
+
+	ai := NewRouter(NewBackend("local", local, 0), NewBackend("cloud", cloud, 0))
+
+	res, err := ai.Analyze(context.Background(), "user", "system")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", *res.TitleCorrected)
+	assert.Equal(t, int32(1), local.queries.Load())
+	assert.Equal(t, int32(1), cloud.queries.Load())
+
+	// the failed backend is skipped during the cooldown
+	_, err = ai.Analyze(context.Background(), "user", "system")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), local.queries.Load())
+	assert.Equal(t, int32(2), cloud.queries.Load())
+
+	// all errors are returned
+	cloud.failing.Store(true)
+	_, err = ai.Analyze(context.Background(), "user", "system")
+	assert.ErrorContains(t, err, `backend "cloud": connection refused`)
+	assert.ErrorContains(t, err, `backend "local": connection refused`)
+}
+
+func TestRouterTimeout(t *testing.T) {
+	cloud := &failingAI{}
+	ai := NewRouter(NewBackend("local", &hangingAI{}, 10*time.Millisecond), NewBackend("cloud", cloud, 0))
+
+	res, err := ai.Analyze(context.Background(), "user", "system")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", *res.TitleCorrected)
+
+	// a cancelled query doesn't fail over
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewRouter(NewBackend("local", &hangingAI{}, 0), NewBackend("cloud", cloud, 0)).Analyze(ctx, "user", "system")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int32(1), cloud.queries.Load())
 }
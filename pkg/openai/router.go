@@ -0,0 +1,126 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"goa.design/clue/log"
+)
+
+// cooldown is the time a failed backend is skipped by the routers
+const cooldown = time.Minute
+
+type backend struct {
+	OpenAI
+	name      string
+	timeout   time.Duration
+	downUntil atomic.Int64 // unix nanoseconds
+}
+
+// Backend is a named AI backend
+type Backend interface {
+	OpenAI
+	Name() string
+	// Healthy reports if the backend didn't fail recently
+	Healthy() bool
+}
+
+// NewBackend names an AI backend, each query is cancelled after the timeout (0 waits)
+func NewBackend(name string, ai OpenAI, timeout time.Duration) Backend {
+	return &backend{
+		OpenAI:  ai,
+		name:    name,
+		timeout: timeout,
+	}
+}
+
+func (b *backend) Name() string {
+	return b.name
+}
+
+func (b *backend) Healthy() bool {
+	return time.Now().UnixNano() >= b.downUntil.Load()
+}
+
+func (b *backend) Analyze(ctx context.Context, user string, system string) (*Analysis, error) {
+	queryCtx, cancel := b.withTimeout(ctx)
+	defer cancel()
+
+	res, err := b.OpenAI.Analyze(queryCtx, user, system)
+	b.track(ctx, err)
+	return res, err
+}
+
+func (b *backend) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, b.timeout)
+}
+
+// track marks the backend as down after an error, invalid output is an error of the model
+func (b *backend) track(ctx context.Context, err error) {
+	if err == nil || ctx.Err() != nil || errors.Is(err, ErrInvalidOutput) {
+		return
+	}
+	b.downUntil.Store(time.Now().Add(cooldown).UnixNano())
+}
+
+type router struct {
+	backends []Backend
+}
+
+// NewRouter sends the queries to the first healthy backend and fails over to the next
+// one on errors. Backends that failed recently are tried last.
+func NewRouter(backends ...Backend) OpenAI {
+	return &router{backends: backends}
+}
+
+func (r *router) Analyze(ctx context.Context, user string, system string) (*Analysis, error) {
+	return route(ctx, r.order(), func(b Backend) (*Analysis, error) {
+		return b.Analyze(ctx, user, system)
+	})
+}
+
+// order returns the healthy backends first, each group keeps the configured order
+func (r *router) order() []Backend {
+	res := make([]Backend, 0, len(r.backends))
+	var down []Backend
+	for _, b := range r.backends {
+		if b.Healthy() {
+			res = append(res, b)
+		} else {
+			down = append(down, b)
+		}
+	}
+	return append(res, down...)
+}
+
+// route calls the backends in order until one succeeds, the errors of all backends are returned
+func route[T any](ctx context.Context, backends []Backend, call func(b Backend) (T, error)) (T, error) {
+	var zero T
+	if len(backends) == 0 {
+		return zero, errors.New("no AI backend")
+	}
+
+	errs := []error{}
+	for i, b := range backends {
+		res, err := call(b)
+		if err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return zero, ctx.Err()
+		}
+
+		errs = append(errs, fmt.Errorf("backend %q: %w", b.Name(), err))
+		if i+1 < len(backends) {
+			log.Printf(ctx, "AI backend %q failed, trying %q: %v", b.Name(), backends[i+1].Name(), err)
+		}
+	}
+
+	return zero, errors.Join(errs...)
+}
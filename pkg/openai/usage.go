@@ -0,0 +1,30 @@
+package openai
+
+import (
+	"context"
+	"time"
+)
+
+// Usage is the token count and latency of a chat completion
+type Usage struct {
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	Latency          time.Duration
+	Err              error // the completion failed, the tokens are 0
+}
+
+type usageKey struct{}
+
+// WithUsage returns a context that reports the usage of every chat completion made with it.
+// The report is called by the goroutine of the query.
+func WithUsage(ctx context.Context, report func(usage Usage)) context.Context {
+	return context.WithValue(ctx, usageKey{}, report)
+}
+
+// reportUsage calls the report of the context, if any
+func reportUsage(ctx context.Context, usage Usage) {
+	if report, ok := ctx.Value(usageKey{}).(func(Usage)); ok {
+		report(usage)
+	}
+}
@@ -0,0 +1,162 @@
+// Package scheduler refreshes the feeds periodically
+package scheduler
+
+import (
+	"context"
+	"math/rand/v2"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/egandro/news-deframer/pkg/source"
+	"goa.design/clue/log"
+)
+
+// jitterFraction is the maximum random delay added to an interval
+const jitterFraction = 0.1
+
+// Updater refreshes a single feed
+type Updater interface {
+	UpdateFeed(feed source.Feed) error
+}
+
+type scheduler struct {
+	updater  Updater
+	feeds    []source.Feed
+	interval time.Duration
+
+	loopsMu sync.Mutex
+	ctx     context.Context
+	wg      *sync.WaitGroup
+	loops   map[string]loop // refresh loop per feed url
+}
+
+// loop is the refresh loop of a feed
+type loop struct {
+	feed   source.Feed
+	cancel context.CancelFunc
+}
+
+type Scheduler interface {
+	Start(ctx context.Context, wg *sync.WaitGroup)
+	Update(feeds []source.Feed)
+}
+
+// NewScheduler initializes a new scheduler, interval is used for feeds without a refresh_interval
+func NewScheduler(updater Updater, feeds []source.Feed, interval time.Duration) Scheduler {
+	res := &scheduler{
+		updater:  updater,
+		feeds:    feeds,
+		interval: interval,
+		loops:    make(map[string]loop),
+	}
+
+	return res
+}
+
+// Start runs a refresh loop per feed until the context is cancelled
+func (s *scheduler) Start(ctx context.Context, wg *sync.WaitGroup) {
+	s.loopsMu.Lock()
+	s.ctx = ctx
+	s.wg = wg
+	s.loopsMu.Unlock()
+
+	// the feeds are updated on startup
+	s.update(s.feeds, false)
+}
+
+// Update replaces the feeds. Loops of removed or changed feeds are stopped,
+// loops of new or changed feeds are started. New feeds are refreshed right away.
+func (s *scheduler) Update(feeds []source.Feed) {
+	s.update(feeds, true)
+}
+
+func (s *scheduler) update(feeds []source.Feed, refreshNew bool) {
+	s.loopsMu.Lock()
+	defer s.loopsMu.Unlock()
+
+	s.feeds = feeds
+	if s.ctx == nil {
+		// not started yet
+		return
+	}
+
+	current := map[string]source.Feed{}
+	for _, feed := range feeds {
+		current[feed.RSS_URL] = feed
+	}
+
+	known := map[string]bool{}
+	for url, l := range s.loops {
+		known[url] = true
+		if feed, ok := current[url]; !ok || !reflect.DeepEqual(feed, l.feed) {
+			l.cancel()
+			delete(s.loops, url)
+		}
+	}
+
+	for _, feed := range feeds {
+		if _, ok := s.loops[feed.RSS_URL]; ok {
+			continue
+		}
+		refresh := refreshNew && !known[feed.RSS_URL]
+
+		interval, err := feed.Interval()
+		if err != nil || interval == 0 {
+			interval = s.interval
+		}
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		s.loops[feed.RSS_URL] = loop{feed: feed, cancel: cancel}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer cancel()
+			s.run(ctx, feed, interval, refresh)
+		}()
+	}
+}
+
+func (s *scheduler) run(ctx context.Context, feed source.Feed, interval time.Duration, refresh bool) {
+	log.Printf(ctx, "refreshing %q every %v", feed.RSS_URL, interval)
+
+	if refresh {
+		s.refresh(ctx, feed)
+	}
+
+	for {
+		timer := time.NewTimer(interval + jitter(interval))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.refresh(ctx, feed)
+	}
+}
+
+// refresh updates the feed, the updater skips it if an update of the same feed is still running
+func (s *scheduler) refresh(ctx context.Context, feed source.Feed) {
+	err := s.updater.UpdateFeed(feed)
+	if err != nil {
+		// only log - try again on the next run
+		log.Errorf(ctx, err, "can't refresh %q", feed.RSS_URL)
+		return
+	}
+
+	log.Printf(ctx, "refreshed %q", feed.RSS_URL)
+}
+
+// jitter returns a random delay, so the feeds are not refreshed all at once
+func jitter(interval time.Duration) time.Duration {
+	maxJitter := int64(float64(interval) * jitterFraction)
+	if maxJitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int64N(maxJitter)) // #nosec G404 -- no secure random required
+}
@@ -0,0 +1,110 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/egandro/news-deframer/pkg/source"
+	"github.com/stretchr/testify/assert"
+)
+
+type testUpdater struct {
+	calls atomic.Int32
+	mu    sync.Mutex
+	feeds map[string]int // refreshes per feed url
+}
+
+func (u *testUpdater) UpdateFeed(feed source.Feed) error {
+	u.calls.Add(1)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.feeds == nil {
+		u.feeds = map[string]int{}
+	}
+	u.feeds[feed.RSS_URL]++
+	return nil
+}
+
+func (u *testUpdater) refreshed(feedUrl string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.feeds[feedUrl]
+}
+
+func TestNewScheduler(t *testing.T) {
+	s := NewScheduler(&testUpdater{}, nil, time.Minute)
+	assert.NotNil(t, s, "Scheduler should be initialized")
+}
+
+func TestSchedulerRefresh(t *testing.T) {
+	updater := &testUpdater{}
+	feeds := []source.Feed{
+		{RSS_URL: "https://example.com/rss", RefreshInterval: "10ms"},
+	}
+
+	s := NewScheduler(updater, feeds, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	s.Start(ctx, &wg)
+
+	assert.Eventually(t, func() bool {
+		return updater.calls.Load() >= 2
+	}, time.Second, 5*time.Millisecond, "Feed should be refreshed periodically")
+
+	// graceful shutdown
+	cancel()
+	wg.Wait()
+}
+
+func TestJitter(t *testing.T) {
+	for range 100 {
+		j := jitter(time.Minute)
+		assert.GreaterOrEqual(t, j, time.Duration(0))
+		assert.Less(t, j, 6*time.Second)
+	}
+	assert.Zero(t, jitter(0))
+}
+
+func TestSchedulerUpdate(t *testing.T) {
+	updater := &testUpdater{}
+	feeds := []source.Feed{
+		{RSS_URL: "https://example.com/rss", RefreshInterval: "1h"},
+	}
+
+	s := NewScheduler(updater, feeds, time.Hour).(*scheduler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	s.Start(ctx, &wg)
+	assert.Len(t, s.loops, 1)
+	time.Sleep(10 * time.Millisecond)
+	assert.Zero(t, updater.calls.Load(), "Feeds should not be refreshed on start")
+
+	// the changed feed is restarted, the new feed is started
+	s.Update([]source.Feed{
+		{RSS_URL: "https://example.com/rss", RefreshInterval: "10ms"},
+		{RSS_URL: "https://example.com/rss2", RefreshInterval: "1h"},
+	})
+	assert.Len(t, s.loops, 2)
+	assert.Equal(t, "10ms", s.loops["https://example.com/rss"].feed.RefreshInterval)
+
+	assert.Eventually(t, func() bool {
+		return updater.refreshed("https://example.com/rss") >= 2
+	}, time.Second, 5*time.Millisecond, "Changed feed should be refreshed with the new interval")
+	assert.Eventually(t, func() bool {
+		return updater.refreshed("https://example.com/rss2") == 1
+	}, time.Second, 5*time.Millisecond, "New feed should be refreshed right away")
+
+	// the removed feeds are stopped
+	s.Update(nil)
+	assert.Empty(t, s.loops)
+
+	// graceful shutdown
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,260 @@
+package source
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Text is item text in a prompt. It is printed escaped like a JSON string without the quotes,
+// so quotes and line breaks of the item can't break the prompt. Raw returns it unchanged.
+type Text string
+
+// String returns the escaped text
+func (t Text) String() string {
+	var sb strings.Builder
+	enc := json.NewEncoder(&sb)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(string(t))
+
+	quoted := strings.TrimSuffix(sb.String(), "\n")
+	return quoted[1 : len(quoted)-1]
+}
+
+// Raw returns the unescaped text
+func (t Text) Raw() string {
+	return string(t)
+}
+
+// PromptData is the item context of the prompt templates, e.g. {{.Title}} or {{join .Categories ", "}}
+type PromptData struct {
+	Title       Text
+	Description Text
+	Content     Text
+	Link        Text
+	Categories  []Text
+	Author      Text
+	Published   Text // the date as in the feed
+	FeedTitle   Text
+	Language    Text
+}
+
+// legacyVariables are the variables of the prompts before templates
+var legacyVariables = map[string]string{
+	"$TITLE":       "{{.Title}}",
+	"$DESCRIPTION": "{{.Description}}",
+}
+
+var legacyVariable = regexp.MustCompile(`\$[A-Z][A-Z_]*`)
+
+var promptFuncs = template.FuncMap{
+	"join": func(texts []Text, sep string) string {
+		res := make([]string, len(texts))
+		for i, t := range texts {
+			res[i] = t.String()
+		}
+		return strings.Join(res, sep)
+	},
+}
+
+// promptTemplates are the parsed user and system prompts
+type promptTemplates struct {
+	user   *template.Template
+	system *template.Template
+}
+
+// parsePrompt parses a prompt template, the legacy variables are replaced.
+// Other text with a dollar sign, e.g. "$USD", is kept.
+func parsePrompt(name string, text string) (*template.Template, error) {
+	text = legacyVariable.ReplaceAllStringFunc(text, func(v string) string {
+		if action, ok := legacyVariables[v]; ok {
+			return action
+		}
+		return v
+	})
+
+	tmpl, err := template.New(name).Funcs(promptFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v prompt: %w", name, err)
+	}
+
+	// templates defined in the prompt are called with any data, they are not checked
+	if unknown := unknownFields(tmpl.Tree.Root, promptDataType); len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown field %v in the %v prompt", strings.Join(unknown, ", "), name)
+	}
+
+	return tmpl, nil
+}
+
+var promptDataType = reflect.TypeFor[PromptData]()
+
+// unknownFields returns the fields of the node that dot doesn't have, also in branches
+// that are not executed. A nil dot is a value of unknown type, its fields are not checked.
+func unknownFields(node parse.Node, dot reflect.Type) []string {
+	res := []string{}
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return res
+		}
+		for _, child := range n.Nodes {
+			res = append(res, unknownFields(child, dot)...)
+		}
+	case *parse.ActionNode:
+		res = append(res, unknownFields(n.Pipe, dot)...)
+	case *parse.IfNode:
+		res = append(res, unknownFields(n.Pipe, dot)...)
+		res = append(res, unknownFields(n.List, dot)...)
+		res = append(res, unknownFields(n.ElseList, dot)...)
+	case *parse.RangeNode:
+		res = append(res, unknownFields(n.Pipe, dot)...)
+		res = append(res, unknownFields(n.List, elemType(pipeType(n.Pipe, dot)))...)
+		res = append(res, unknownFields(n.ElseList, dot)...)
+	case *parse.WithNode:
+		res = append(res, unknownFields(n.Pipe, dot)...)
+		res = append(res, unknownFields(n.List, pipeType(n.Pipe, dot))...)
+		res = append(res, unknownFields(n.ElseList, dot)...)
+	case *parse.TemplateNode:
+		res = append(res, unknownFields(n.Pipe, dot)...)
+	case *parse.PipeNode:
+		if n == nil {
+			return res
+		}
+		for _, cmd := range n.Cmds {
+			for _, arg := range cmd.Args {
+				res = append(res, unknownFields(arg, dot)...)
+			}
+		}
+	case *parse.FieldNode:
+		if _, ok := fieldType(dot, n.Ident); !ok {
+			res = append(res, n.String())
+		}
+	case *parse.VariableNode:
+		// $ is the prompt data, other variables are not checked
+		if n.Ident[0] == "$" {
+			if _, ok := fieldType(promptDataType, n.Ident[1:]); !ok {
+				res = append(res, n.String())
+			}
+		}
+	case *parse.ChainNode:
+		res = append(res, unknownFields(n.Node, dot)...)
+	}
+
+	return res
+}
+
+// pipeType returns the type of a pipeline with a single field, nil for other pipelines
+func pipeType(pipe *parse.PipeNode, dot reflect.Type) reflect.Type {
+	if pipe == nil || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return nil
+	}
+
+	switch arg := pipe.Cmds[0].Args[0].(type) {
+	case *parse.FieldNode:
+		t, _ := fieldType(dot, arg.Ident)
+		return t
+	case *parse.VariableNode:
+		if arg.Ident[0] == "$" {
+			t, _ := fieldType(promptDataType, arg.Ident[1:])
+			return t
+		}
+	case *parse.DotNode:
+		return dot
+	}
+	return nil
+}
+
+// elemType returns the type of the elements a range iterates over, nil if unknown
+func elemType(t reflect.Type) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return t.Elem()
+	}
+	return nil
+}
+
+// fieldType resolves the fields and methods of a chain like .Title.Raw. It returns the
+// type of the last one, nil if it is unknown, and false if t doesn't have a field of the chain.
+func fieldType(t reflect.Type, idents []string) (reflect.Type, bool) {
+	for _, ident := range idents {
+		if t == nil {
+			return nil, true
+		}
+		if method, ok := t.MethodByName(ident); ok {
+			if method.Type.NumOut() == 0 {
+				return nil, true
+			}
+			t = method.Type.Out(0)
+			continue
+		}
+		if t.Kind() == reflect.Struct {
+			if field, ok := t.FieldByName(ident); ok && field.IsExported() {
+				t = field.Type
+				continue
+			}
+		}
+		return nil, false
+	}
+	return t, true
+}
+
+// parse parses the user and system prompt templates
+func (p Prompt) parse() (*promptTemplates, []error) {
+	errs := []error{}
+
+	user, err := parsePrompt("user", p.User)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	system, err := parsePrompt("system", p.System)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return &promptTemplates{user: user, system: system}, nil
+}
+
+// Render executes the user and system prompt templates with the item.
+// The templates are parsed once by the validation of the source.
+func (p Prompt) Render(data PromptData) (string, string, error) {
+	templates := p.templates
+	if templates == nil {
+		var errs []error
+		templates, errs = p.parse()
+		if len(errs) > 0 {
+			return "", "", errors.Join(errs...)
+		}
+	}
+
+	user, err := renderPrompt(templates.user, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	system, err := renderPrompt(templates.system, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	return user, system, nil
+}
+
+func renderPrompt(tmpl *template.Template, data PromptData) (string, error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("can't render the %v prompt: %w", tmpl.Name(), err)
+	}
+	return sb.String(), nil
+}
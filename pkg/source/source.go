@@ -2,30 +2,237 @@ package source
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 )
 
+// DefaultBackend names the AI backend of the configuration (AI_URL and AI_MODEL)
+const DefaultBackend = "default"
+
+// outputModes are the structured output modes of a backend
+var outputModes = map[string]bool{"": true, "json_schema": true, "tools": true, "text": true}
+
 type Feed struct {
-	RSS_URL  string `json:"rss_url"`
-	Language string `json:"language"`
+	RSS_URL         string   `json:"rss_url"`
+	Language        string   `json:"language"`
+	Title           string   `json:"title,omitempty"`            // name of the feed in the prompts, the upstream title if empty
+	RefreshInterval string   `json:"refresh_interval,omitempty"` // e.g. "30m", default from the config
+	Backends        []string `json:"backends,omitempty"`         // AI backends in failover order, default from the prompt
+}
+
+// Interval returns the refresh interval of the feed, 0 if not set
+func (f Feed) Interval() (time.Duration, error) {
+	if f.RefreshInterval == "" {
+		return 0, nil
+	}
+
+	interval, err := time.ParseDuration(f.RefreshInterval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid refresh_interval of feed %q: %w", f.RSS_URL, err)
+	}
+
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid refresh_interval of feed %q: must be positive", f.RSS_URL)
+	}
+
+	return interval, nil
 }
 
 type Prompt struct {
-	User     string `json:"user"`
-	System   string `json:"system"`
-	Language string `json:"language"`
+	User     string   `json:"user"`
+	System   string   `json:"system"`
+	Language string   `json:"language"`
+	Backends []string `json:"backends,omitempty"` // AI backends of the language in failover order
+
+	templates *promptTemplates // parsed by the validation
+}
+
+// Backend is an OpenAI compatible AI backend, e.g. LM Studio, Ollama or OpenAI
+type Backend struct {
+	Name        string `json:"name"`
+	URL         string `json:"url,omitempty"` // the OpenAI API if empty
+	Model       string `json:"model"`
+	APIKeyEnv   string `json:"api_key_env,omitempty"`  // environment variable with the API key
+	APIKeyFile  string `json:"api_key_file,omitempty"` // file with the API key, e.g. a docker secret
+	Output      string `json:"output,omitempty"`       // json_schema, tools or text, default from the config
+	Timeout     string `json:"timeout,omitempty"`      // e.g. "60s", default from the config
+	Concurrency int    `json:"concurrency,omitempty"`  // queries at once, default from the config
+}
+
+// APIKey reads the API key from the environment or the file, empty if none is set
+func (b Backend) APIKey() (string, error) {
+	if b.APIKeyEnv != "" {
+		key, ok := os.LookupEnv(b.APIKeyEnv)
+		if !ok {
+			return "", fmt.Errorf("backend %q: environment variable %q is not set", b.Name, b.APIKeyEnv)
+		}
+		return key, nil
+	}
+
+	if b.APIKeyFile != "" {
+		data, err := os.ReadFile(b.APIKeyFile)
+		if err != nil {
+			return "", fmt.Errorf("backend %q: can't read the API key: %w", b.Name, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return "", nil
+}
+
+// RequestTimeout returns the timeout of a query, 0 if not set
+func (b Backend) RequestTimeout() (time.Duration, error) {
+	if b.Timeout == "" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(b.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout of backend %q: %w", b.Name, err)
+	}
+
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout of backend %q: must be positive", b.Name)
+	}
+
+	return timeout, nil
+}
+
+// Ensemble rates every item with several backends and combines the ratings to a consensus
+type Ensemble struct {
+	Backends []string `json:"backends"`
+	Quorum   int      `json:"quorum,omitempty"` // ratings needed for a consensus, default a majority of the backends
+}
+
+// MinRatings returns the quorum
+func (e Ensemble) MinRatings() int {
+	if e.Quorum > 0 {
+		return e.Quorum
+	}
+	return len(e.Backends)/2 + 1
+}
+
+// Price is the price of a model in any currency per million tokens
+type Price struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// Cost returns the price of the tokens
+func (p Price) Cost(promptTokens int64, completionTokens int64) float64 {
+	return (float64(promptTokens)*p.Prompt + float64(completionTokens)*p.Completion) / 1e6
 }
 
 type Source struct {
-	Feeds   []Feed   `json:"feeds"`
-	Prompts []Prompt `json:"prompts"`
+	Feeds    []Feed           `json:"feeds"`
+	Prompts  []Prompt         `json:"prompts"`
+	Backends []Backend        `json:"backends,omitempty"`
+	Ensemble *Ensemble        `json:"ensemble,omitempty"` // replaces the backends of the feeds and prompts
+	Prices   map[string]Price `json:"prices,omitempty"`   // by model
 }
 
 // ParseString parses the feed from a JSON string and returns feeds
 func ParseString(feedJSON string) (*Source, error) {
 	var source Source
 	err := json.Unmarshal([]byte(feedJSON), &source)
-	return &source, err
+	if err != nil {
+		return &source, err
+	}
+
+	return &source, source.Validate()
+}
+
+// Validate returns all errors of the feeds, prompts and backends, nil if the source is valid.
+// The prompt templates are parsed and kept for rendering.
+func (s *Source) Validate() error {
+	errs := []error{}
+
+	backends := map[string]bool{DefaultBackend: true}
+	for i, backend := range s.Backends {
+		switch {
+		case backend.Name == "":
+			errs = append(errs, fmt.Errorf("backend %v: missing name", i))
+		case backends[backend.Name]:
+			errs = append(errs, fmt.Errorf("backend %v: duplicate or reserved name %q", i, backend.Name))
+		}
+		backends[backend.Name] = true
+
+		if backend.Model == "" {
+			errs = append(errs, fmt.Errorf("backend %v: missing model", i))
+		}
+		if !outputModes[backend.Output] {
+			errs = append(errs, fmt.Errorf("backend %v: unknown output %q", i, backend.Output))
+		}
+		if _, err := backend.RequestTimeout(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	unknown := func(what string, names []string) {
+		for _, name := range names {
+			if !backends[name] {
+				errs = append(errs, fmt.Errorf("%v: unknown backend %q", what, name))
+			}
+		}
+	}
+
+	feeds := map[string]bool{}
+	for i, feed := range s.Feeds {
+		u, err := url.Parse(feed.RSS_URL)
+		switch {
+		case feed.RSS_URL == "":
+			errs = append(errs, fmt.Errorf("feed %v: missing rss_url", i))
+		case err != nil || u.Scheme == "":
+			errs = append(errs, fmt.Errorf("feed %v: rss_url %q is not an absolute url", i, feed.RSS_URL))
+		case feeds[feed.RSS_URL]:
+			errs = append(errs, fmt.Errorf("feed %v: duplicate rss_url %q", i, feed.RSS_URL))
+		}
+		feeds[feed.RSS_URL] = true
+
+		if _, err := feed.Interval(); err != nil {
+			errs = append(errs, err)
+		}
+		unknown(fmt.Sprintf("feed %v", i), feed.Backends)
+	}
+
+	prompts := map[string]bool{}
+	for i, prompt := range s.Prompts {
+		if prompt.User == "" {
+			errs = append(errs, fmt.Errorf("prompt %v: missing user prompt", i))
+		}
+		templates, promptErrs := prompt.parse()
+		for _, err := range promptErrs {
+			errs = append(errs, fmt.Errorf("prompt %v: %w", i, err))
+		}
+		s.Prompts[i].templates = templates
+		if prompts[prompt.Language] {
+			errs = append(errs, fmt.Errorf("prompt %v: duplicate language %q", i, prompt.Language))
+		}
+		prompts[prompt.Language] = true
+		unknown(fmt.Sprintf("prompt %v", i), prompt.Backends)
+	}
+
+	if s.Ensemble != nil {
+		if len(s.Ensemble.Backends) < 2 {
+			errs = append(errs, errors.New("ensemble: at least 2 backends are required"))
+		}
+		if s.Ensemble.Quorum < 0 || s.Ensemble.Quorum > len(s.Ensemble.Backends) {
+			errs = append(errs, fmt.Errorf("ensemble: quorum %v is not between 1 and %v", s.Ensemble.Quorum, len(s.Ensemble.Backends)))
+		}
+		unknown("ensemble", s.Ensemble.Backends)
+	}
+
+	for model, price := range s.Prices {
+		if price.Prompt < 0 || price.Completion < 0 {
+			errs = append(errs, fmt.Errorf("price of model %q: must not be negative", model))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 // ParseFile parses the feed from a JSON file and returns feeds
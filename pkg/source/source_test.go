@@ -1,7 +1,11 @@
 package source
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -58,3 +62,157 @@ func TestParseString(t *testing.T) {
 	assert.EqualValues(t, "Fasse den Text in Deutsch zusammen.", prompt2.User)
 	assert.EqualValues(t, "Du bist ein Reporter.", prompt2.System)
 }
+
+func TestRefreshInterval(t *testing.T) {
+	feedJSON := `
+	{
+		"feeds": [
+			{
+				"rss_url": "https://example.com/rss",
+				"language": "en",
+				"refresh_interval": "30m"
+			},
+			{
+				"rss_url": "https://example.com/rss2",
+				"language": "de"
+			}
+		]
+	}
+	`
+	source, err := ParseString(feedJSON)
+	assert.NoError(t, err)
+
+	interval, err := source.Feeds[0].Interval()
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, interval)
+
+	interval, err = source.Feeds[1].Interval()
+	assert.NoError(t, err)
+	assert.Zero(t, interval, "Interval should default to 0")
+
+	_, err = ParseString(`{ "feeds": [ { "rss_url": "https://example.com/rss", "refresh_interval": "soon" } ] }`)
+	assert.Error(t, err, "Invalid intervals should be rejected")
+
+	_, err = ParseString(`{ "feeds": [ { "rss_url": "https://example.com/rss", "refresh_interval": "-5m" } ] }`)
+	assert.Error(t, err, "Negative intervals should be rejected")
+}
+
+func TestValidate(t *testing.T) {
+	_, err := ParseString(`{ "feeds": [ { "rss_url": "https://example.com/rss" }, { "rss_url": "https://example.com/rss" } ] }`)
+	assert.ErrorContains(t, err, "duplicate rss_url")
+
+	_, err = ParseString(`{ "feeds": [ { "rss_url": "example.com/rss" } ] }`)
+	assert.ErrorContains(t, err, "not an absolute url")
+
+	_, err = ParseString(`{ "prompts": [ { "user": "a", "language": "en" }, { "user": "b", "language": "en" } ] }`)
+	assert.ErrorContains(t, err, "duplicate language")
+
+	// all errors are reported
+	_, err = ParseString(`{ "feeds": [ { "rss_url": "" } ], "prompts": [ { "language": "en" } ] }`)
+	assert.ErrorContains(t, err, "missing rss_url")
+	assert.ErrorContains(t, err, "missing user prompt")
+
+	_, err = ParseString(`{
+		"feeds": [ { "rss_url": "https://example.com/rss", "backends": [ "local", "cloud" ] } ],
+		"prompts": [ { "user": "a", "language": "en", "backends": [ "default" ] } ],
+		"backends": [ { "name": "local", "model": "phi-4" }, { "name": "local", "model": "llama", "timeout": "soon", "output": "xml" } ]
+	}`)
+	assert.ErrorContains(t, err, `duplicate or reserved name "local"`)
+	assert.ErrorContains(t, err, "invalid timeout")
+	assert.ErrorContains(t, err, `unknown output "xml"`)
+	assert.ErrorContains(t, err, `feed 0: unknown backend "cloud"`)
+	assert.NotContains(t, err.Error(), `unknown backend "default"`)
+
+	_, err = ParseString(`{ "ensemble": { "backends": [ "default" ], "quorum": 2 } }`)
+	assert.ErrorContains(t, err, "at least 2 backends")
+	assert.ErrorContains(t, err, "quorum 2 is not between 1 and 1")
+
+	assert.Equal(t, 2, Ensemble{Backends: []string{"a", "b", "c"}}.MinRatings())
+	assert.Equal(t, 1, Ensemble{Backends: []string{"a", "b", "c"}, Quorum: 1}.MinRatings())
+
+	_, err = ParseString(`{ "prices": { "gpt-4o-mini": { "prompt": -1, "completion": 0.6 } } }`)
+	assert.ErrorContains(t, err, `price of model "gpt-4o-mini": must not be negative`)
+
+	price := Price{Prompt: 0.15, Completion: 0.6}
+	assert.InDelta(t, 0.75, price.Cost(1_000_000, 1_000_000), 1e-9)
+}
+
+func TestPromptRender(t *testing.T) {
+	data := PromptData{
+		Title:       `Say "$DESCRIPTION"`,
+		Description: "line 1\nline 2",
+		Categories:  []Text{"politics", "world"},
+		FeedTitle:   "Example",
+	}
+
+	// the legacy variables are replaced in the prompt, not in the item
+	prompt := Prompt{User: "Title: $TITLE - Content: $DESCRIPTION", System: "{{.FeedTitle}} [{{join .Categories \", \"}}] {{.Title.Raw}}"}
+	user, system, err := prompt.Render(data)
+	assert.NoError(t, err)
+	assert.Equal(t, `Title: Say \"$DESCRIPTION\" - Content: line 1\nline 2`, user)
+	assert.Equal(t, `Example [politics, world] Say "$DESCRIPTION"`, system)
+
+	// other dollar signs are text
+	prompt = Prompt{User: "Prices in $USD for {{.Title}}"}
+	user, _, err = prompt.Render(data)
+	assert.NoError(t, err)
+	assert.Equal(t, `Prices in $USD for Say \"$DESCRIPTION\"`, user)
+
+	src, err := ParseString(`{ "prompts": [ { "user": "{{range .Categories}}{{.Raw}}{{end}} {{with .Link}}{{.}}{{end}} {{$.Title}}", "language": "en" } ] }`)
+	assert.NoError(t, err)
+	assert.NotNil(t, src.Prompts[0].templates, "Templates should be parsed once")
+
+	// unknown fields are reported in branches that are not executed as well
+	_, err = ParseString(`{ "prompts": [ { "user": "{{.Headline}} {{if .Link}}{{.Autor}}{{end}}", "system": "{{range .Categories}}{{.Name}}{{end}} {{$.Title.Size}}", "language": "en" } ] }`)
+	assert.ErrorContains(t, err, "prompt 0: unknown field .Headline, .Autor in the user prompt")
+	assert.ErrorContains(t, err, "prompt 0: unknown field .Name, $.Title.Size in the system prompt")
+
+	_, err = ParseString(`{ "prompts": [ { "user": "{{.Title", "language": "en" } ] }`)
+	assert.ErrorContains(t, err, "invalid user prompt")
+}
+
+func TestBackendAPIKey(t *testing.T) {
+	backend := Backend{Name: "local"}
+	key, err := backend.APIKey()
+	assert.NoError(t, err)
+	assert.Empty(t, key)
+
+	t.Setenv("TEST_API_KEY", "secret")
+	backend.APIKeyEnv = "TEST_API_KEY"
+	key, err = backend.APIKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", key)
+
+	backend.APIKeyEnv = "TEST_MISSING_API_KEY"
+	_, err = backend.APIKey()
+	assert.ErrorContains(t, err, "is not set")
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	assert.NoError(t, os.WriteFile(keyFile, []byte("file-secret\n"), 0o600))
+	backend = Backend{Name: "cloud", APIKeyFile: keyFile}
+	key, err = backend.APIKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "file-secret", key)
+}
+
+func TestWatch(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "source.json")
+	assert.NoError(t, os.WriteFile(filePath, []byte(`{}`), 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changed := Watch(ctx, filePath, 5*time.Millisecond)
+
+	assert.NoError(t, os.WriteFile(filePath, []byte(`{ "feeds": [] }`), 0o600))
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("Change should be signaled")
+	}
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, ok := <-changed
+		return !ok
+	}, time.Second, 5*time.Millisecond, "Channel should be closed")
+}
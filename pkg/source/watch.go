@@ -0,0 +1,49 @@
+package source
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Watch polls the file every interval and signals when its modification time or size changed.
+// Polling works with bind mounts and editors that replace the file. The channel is closed
+// when the context is cancelled.
+func Watch(ctx context.Context, filePath string, interval time.Duration) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	last, _ := os.Stat(filePath)
+
+	go func() {
+		defer close(changed)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current, err := os.Stat(filePath)
+			if err != nil {
+				// e.g. replaced right now, compare on the next tick
+				continue
+			}
+
+			if last != nil && current.ModTime().Equal(last.ModTime()) && current.Size() == last.Size() {
+				continue
+			}
+			last = current
+
+			// a pending signal covers this change as well
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changed
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -14,11 +15,13 @@ import (
 
 // web service example implementation.
 // The example methods log the requests and return zero values.
-type websrvc struct{}
+type websrvc struct {
+	d deframer.Deframer
+}
 
 // NewWeb returns the web service implementation.
-func NewWeb() web.Service {
-	return &websrvc{}
+func NewWeb(d deframer.Deframer) web.Service {
+	return &websrvc{d: d}
 }
 
 // Returns the index page in HTML
@@ -43,11 +46,6 @@ func (s *websrvc) Index(ctx context.Context) (res string, err error) {
 </body>
 </html>`
 
-	d, err := deframer.NewDeframer(ctx)
-	if err != nil {
-		return "", err
-	}
-
 	type Item struct {
 		Href  string
 		Title string
@@ -55,15 +53,15 @@ func (s *websrvc) Index(ctx context.Context) (res string, err error) {
 
 	items := []Item{}
 
-	caches, err := d.FindAllCaches()
+	feeds, err := s.d.FindAllFeeds()
 	if err != nil {
 		return "", err
 	}
 
-	for _, cache := range caches {
+	for _, feed := range feeds {
 		items = append(items, Item{
-			Href:  fmt.Sprintf("/feed/%v", cache.ID),
-			Title: cache.Title,
+			Href:  fmt.Sprintf("/feed/%v", feed.ID),
+			Title: feed.Title,
 		})
 	}
 
@@ -78,31 +76,104 @@ func (s *websrvc) Index(ctx context.Context) (res string, err error) {
 	return
 }
 
-// Returns the feed with the given xml
+// Returns the feed with the given id as rss, atom or json feed
 func (s *websrvc) Feed(ctx context.Context, p *web.FeedPayload) (res *web.FeedResult, resp io.ReadCloser, err error) {
 	res = &web.FeedResult{}
 	log.Printf(ctx, "web.feed")
 	//res = "feed " + p.FeedID
 
-	d, err := deframer.NewDeframer(ctx)
+	entry, err := s.d.FindFeedByID(p.FeedID)
+	if err != nil {
+		return res, resp, err
+	}
+
+	if entry == nil {
+		return res, resp, web.InvalidFeedID(fmt.Sprintf("feed %v not found", p.FeedID))
+	}
+
+	format := negotiateFormat(p.Format, p.Accept)
+
+	feed, err := s.d.RenderFeed(entry, deframer.FeedOptions{
+		MaxScore:    p.MaxScore,
+		ScoreType:   scoreType(p.ScoreType),
+		Placeholder: p.Placeholder,
+		Embedded:    p.Embedded,
+		Format:      format,
+	})
 	if err != nil {
 		return res, resp, err
 	}
 
-	entry, err := d.FindCacheByID(p.FeedID)
+	res.Type = format.ContentType()
+	res.Length = int64(len(feed))
+
+	// resp is the HTTP response body stream.
+	resp = io.NopCloser(strings.NewReader(feed))
+
+	return
+}
+
+// Deframes the feed with the given url and returns it as rss, atom or json feed
+func (s *websrvc) Proxy(ctx context.Context, p *web.ProxyPayload) (res *web.ProxyResult, resp io.ReadCloser, err error) {
+	res = &web.ProxyResult{}
+	log.Printf(ctx, "web.proxy")
+
+	lang := ""
+	if p.Lang != nil {
+		lang = *p.Lang
+	}
+
+	opts := deframer.FeedOptions{
+		MaxScore:    p.MaxScore,
+		ScoreType:   scoreType(p.ScoreType),
+		Placeholder: p.Placeholder,
+		Embedded:    p.Embedded,
+		Format:      negotiateFormat(p.Format, p.Accept),
+	}
+
+	feed, err := s.d.DeframeURL(p.URL, lang, opts)
 	if err != nil {
+		if errors.Is(err, deframer.ErrInvalidURL) {
+			return res, resp, web.InvalidURL(err.Error())
+		}
+		if errors.Is(err, deframer.ErrUnknownLanguage) {
+			return res, resp, web.UnknownLanguage(err.Error())
+		}
 		return res, resp, err
 	}
 
-	res.Type = "application/xml;charset=UTF-8"
-	res.Length = int64(len(entry.Cache))
+	res.Type = opts.Format.ContentType()
+	res.Length = int64(len(feed))
 
 	// resp is the HTTP response body stream.
-	resp = io.NopCloser(strings.NewReader(entry.Cache))
+	resp = io.NopCloser(strings.NewReader(feed))
 
 	return
 }
 
+// negotiateFormat selects the feed format by the optional format parameter and accept header
+func negotiateFormat(format *string, accept *string) deframer.Format {
+	f := ""
+	if format != nil {
+		f = *format
+	}
+
+	a := ""
+	if accept != nil {
+		a = *accept
+	}
+
+	return deframer.NegotiateFormat(f, a)
+}
+
+// scoreType returns the optional score type, empty for the highest score
+func scoreType(scoreType *string) string {
+	if scoreType == nil {
+		return ""
+	}
+	return *scoreType
+}
+
 // renderTemplate takes an template string and some data,
 // and returns the rendered template as a string.
 func renderTemplate(tpl string, data any) (string, error) {